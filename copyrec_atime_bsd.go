@@ -0,0 +1,19 @@
+//go:build darwin || freebsd || netbsd
+// +build darwin freebsd netbsd
+
+package copyrec
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+func getAtime(fileInfo os.FileInfo) time.Time {
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileInfo.ModTime()
+	}
+
+	return time.Unix(stat.Atimespec.Unix())
+}
@@ -0,0 +1,11 @@
+//go:build darwin || freebsd || netbsd
+// +build darwin freebsd netbsd
+
+package copyrec_test
+
+import "time"
+
+func getTimes(path string) (time.Time, time.Time) {
+	_, stat := getFileInfoAndStat(path)
+	return time.Unix(stat.Atimespec.Unix()), time.Unix(stat.Mtimespec.Unix())
+}
@@ -0,0 +1,19 @@
+//go:build !linux && !windows && !darwin && !freebsd && !netbsd
+// +build !linux,!windows,!darwin,!freebsd,!netbsd
+
+package copyrec
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+func getAtime(fileInfo os.FileInfo) time.Time {
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileInfo.ModTime()
+	}
+
+	return time.Unix(stat.Atim.Unix())
+}
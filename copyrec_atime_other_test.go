@@ -0,0 +1,11 @@
+//go:build !windows && !darwin && !freebsd && !netbsd
+// +build !windows,!darwin,!freebsd,!netbsd
+
+package copyrec_test
+
+import "time"
+
+func getTimes(path string) (time.Time, time.Time) {
+	_, stat := getFileInfoAndStat(path)
+	return time.Unix(stat.Atim.Unix()), time.Unix(stat.Mtim.Unix())
+}
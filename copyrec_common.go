@@ -1,5 +1,16 @@
 package copyrec
 
+import (
+	"fmt"
+	"hash"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
 type DirAction int
 
 const (
@@ -8,6 +19,188 @@ const (
 	DirSkip
 )
 
+type CopyMethod int
+
+const (
+	// Clone file data with FICLONE ioctl (reflink). Supported only by some filesystems, e.g. btrfs or xfs.
+	CopyMethodReflink CopyMethod = iota
+	// Copy file data in kernel with copy_file_range syscall.
+	CopyMethodCopyFileRange
+	// Copy file data in kernel with sendfile syscall.
+	CopyMethodSendfile
+	// Copy file data in userspace with read/write syscalls.
+	CopyMethodUserspace
+)
+
+// Copy methods tried in this order if Options.CopyMethods not defined.
+var DefaultCopyMethods = []CopyMethod{CopyMethodReflink, CopyMethodCopyFileRange, CopyMethodSendfile, CopyMethodUserspace}
+
+func (m CopyMethod) String() string {
+	switch m {
+	case CopyMethodReflink:
+		return "reflink"
+	case CopyMethodCopyFileRange:
+		return "copy_file_range"
+	case CopyMethodSendfile:
+		return "sendfile"
+	case CopyMethodUserspace:
+		return "userspace"
+	default:
+		return fmt.Sprintf("CopyMethod(%d)", int(m))
+	}
+}
+
+// Decides whether existing destination file is unchanged and can be left in place.
+type CompareMethod int
+
+const (
+	// Always copy files.
+	CompareNone CompareMethod = iota
+	// Size and modification time should be the same. Useful only along with Options.PreserveTimes.
+	CompareSizeAndModTime
+	// Size, modification time, mode and ownership should be the same.
+	CompareSizeModTimeModeAndOwner
+	// Size and SHA-256 hash of content should be the same.
+	CompareContent
+)
+
+type SpecialFileAction int
+
+const (
+	SpecialFileSkip SpecialFileAction = iota
+	SpecialFileRecreate
+	SpecialFileFail
+)
+
+// What to do with source symlinks.
+type SymlinkAction int
+
+const (
+	// Recreate symlinks with the same destinations.
+	SymlinkPreserve SymlinkAction = iota
+	// Copy files and directories symlinks point to instead of symlinks. Fails on dangling symlinks and loops.
+	SymlinkFollow
+	// Recreate symlinks, but make absolute destinations inside source relative, so that they point inside destination.
+	SymlinkRewriteAbsolute
+	// Recreate symlinks, but skip dangling ones.
+	SymlinkSkipDangling
+)
+
+// What to do with symlinks pointing outside of source.
+type EscapingSymlinkAction int
+
+const (
+	// Process such symlinks as any other symlinks.
+	EscapingSymlinkAllow EscapingSymlinkAction = iota
+	// Skip such symlinks.
+	EscapingSymlinkSkip
+	// Recreate such symlinks with destinations resolved as if source were the root directory, so that they point
+	// inside destination. Not supported with SymlinkFollow.
+	EscapingSymlinkRewrite
+	// Fail copying.
+	EscapingSymlinkFail
+)
+
+func (a EscapingSymlinkAction) String() string {
+	switch a {
+	case EscapingSymlinkAllow:
+		return "allow"
+	case EscapingSymlinkSkip:
+		return "skip"
+	case EscapingSymlinkRewrite:
+		return "rewrite"
+	case EscapingSymlinkFail:
+		return "fail"
+	default:
+		return fmt.Sprintf("EscapingSymlinkAction(%d)", int(a))
+	}
+}
+
+// Default maximal number of nested symlinks to directories followed.
+const DefaultMaxSymlinkDepth = 40
+
+type PlanActionType string
+
+const (
+	PlanActionMkdir         PlanActionType = "mkdir"
+	PlanActionChmod         PlanActionType = "chmod"
+	PlanActionChown         PlanActionType = "chown"
+	PlanActionCreateFile    PlanActionType = "create-file"
+	PlanActionCreateSymlink PlanActionType = "create-symlink"
+	PlanActionLink          PlanActionType = "link"
+	PlanActionMknod         PlanActionType = "mknod"
+	// Existing non-directory entry removed to put a new entry in place of it.
+	PlanActionReplace PlanActionType = "replace"
+	// Existing directory removed with all of its contents to put a new entry in place of it.
+	PlanActionRemoveAll PlanActionType = "remove-all"
+	// Destination entry missing in source removed with all of its contents in mirror mode.
+	PlanActionRemove PlanActionType = "remove"
+)
+
+// Destination change that Run would make, returned by Plan.
+type PlanAction struct {
+	Type PlanActionType `json:"type"`
+	Path string         `json:"path"`
+	// Source file for created files and special files.
+	Src string `json:"src,omitempty"`
+	// Symlink destination or hard link target.
+	Target string       `json:"target,omitempty"`
+	Mode   *os.FileMode `json:"mode,omitempty"`
+	UID    *int         `json:"uid,omitempty"`
+	GID    *int         `json:"gid,omitempty"`
+}
+
+// Counters accumulated since the start of Run.
+type Progress struct {
+	// Source entries walked, including entries of matched directories.
+	EntriesWalked int64
+	// Source entries matched, including entries of matched directories.
+	EntriesMatched int64
+	// Regular files copied or hard linked.
+	FilesCopied int64
+	// Bytes of file data copied.
+	BytesCopied int64
+	// Source path processed last.
+	CurrentPath string
+}
+
+// Statistics of copying returned by RunWithResult.
+type Result struct {
+	// Regular files copied or hard linked.
+	Files int64
+	// Directories created or updated in destination.
+	Dirs     int64
+	Symlinks int64
+	// Named pipes and devices recreated.
+	SpecialFiles int64
+	// Source entries skipped because copying of their types not supported or not enabled.
+	Skipped int64
+	// Bytes of file data copied.
+	Bytes int64
+	// Existing destination entries removed to put copied entries in place of them.
+	Replaced int64
+	// Destination entries missing in source removed in mirror mode.
+	Removed int64
+	// Files and symlinks left in place because they are the same as in source.
+	Unchanged int64
+	Elapsed   time.Duration
+}
+
+// Returned if content of copied file differs from source content.
+type ChecksumMismatchError struct {
+	Src          string
+	Dest         string
+	SrcChecksum  []byte
+	DestChecksum []byte
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("checksum %x of file %q differs from checksum %x of source file %q", e.DestChecksum, e.Dest, e.SrcChecksum, e.Src)
+}
+
+// Default minimal interval between Progress calls.
+const DefaultProgressInterval = time.Second
+
 type Options struct {
 	// Set UID for copied files/directories.
 	UID *uint32
@@ -25,6 +218,142 @@ type Options struct {
 	MatchFile func(path string) (bool, error)
 
 	AbortIfDestParentDirNotExists bool
+
+	// Methods of copying file data, tried in the specified order until the first one supported for a file.
+	// Methods not in the list are never used. If not defined, then DefaultCopyMethods are used.
+	CopyMethods []CopyMethod
+
+	// Function called for every copied file with the method actually used to copy its data.
+	OnFileDataCopied func(src, dest string, method CopyMethod)
+
+	// Recreate hard links between copied source files in destination instead of copying the same data again.
+	PreserveHardLinks bool
+
+	// Copy only data regions of source files, leaving holes in destination files (Linux only).
+	PreserveSparseFiles bool
+
+	// Preserve access and modification times of copied files, directories and symlinks.
+	PreserveTimes bool
+
+	// Copy extended attributes of files, directories and symlinks (Linux only).
+	CopyXattrs bool
+
+	// Patterns (in path.Match syntax, e.g. "user.*" or "security.capability") of extended attributes names to copy.
+	// If not defined, then all extended attributes are copied.
+	XattrIncludes []string
+
+	// Patterns of extended attributes names never copied, e.g. "security.selinux". Take precedence over XattrIncludes.
+	XattrExcludes []string
+
+	// Function called for every extended attribute that can't be set in destination, e.g. not supported by the
+	// destination filesystem or not permitted. Such attributes are skipped without aborting the copying.
+	// If not defined, then a warning is logged.
+	OnXattrError func(path, name string, err error)
+
+	// What to do with named pipes (FIFOs). Skipped with a warning by default.
+	FIFOAction SpecialFileAction
+
+	// What to do with character devices. Skipped with a warning by default.
+	CharDeviceAction SpecialFileAction
+
+	// What to do with block devices. Skipped with a warning by default.
+	BlockDeviceAction SpecialFileAction
+
+	// Function called for every socket instead of skipping it with a warning. Sockets can't be recreated.
+	OnSocket func(src, dest string) error
+
+	// What to do with symlinks. Recreated as is by default.
+	// Followed symlinks to directories are matched with MatchDir and walked like directories, with paths below the
+	// symlink passed to matching functions.
+	Symlinks SymlinkAction
+
+	// Maximal number of nested symlinks to directories followed with SymlinkFollow.
+	// If not defined, then DefaultMaxSymlinkDepth is used.
+	MaxSymlinkDepth int
+
+	// What to do with symlinks pointing outside of source. Symlink destinations resolved relative to source along with
+	// all symlinks on the way. Allowed by default.
+	EscapingSymlinks EscapingSymlinkAction
+
+	// Function called for every symlink pointing outside of source with the action taken and the original symlink
+	// destination. If not defined, then a warning is logged for skipped and rewritten symlinks.
+	OnEscapingSymlink func(src, linkDestination string, action EscapingSymlinkAction)
+
+	// Number of files copied in parallel. Directories are still created before their entries, in one goroutine.
+	// Callbacks for copied files can be called concurrently. If not defined or 1, then files copied sequentially.
+	Concurrency int
+
+	// Write files, hard links and symlinks with temporary names in destination directory and rename them over
+	// existing destination entries, so that readers never see missing or partially written files.
+	AtomicReplace bool
+
+	// Copy to a staging directory next to destination and swap them after copying finished, so that destination
+	// changes all at once and stays untouched on failure. Destination ends up with copied entries only.
+	// Source should be a directory. Callbacks called with paths in the staging directory. Can't be planned with Plan.
+	StageAndSwap bool
+
+	// Path the previous destination moved to after swapping. If not defined, then the previous destination removed.
+	// Failing to move or remove it only logs a warning, as destination is already swapped by then.
+	OldDestPath string
+
+	// Remove destination entries that have no corresponding source entries, but would be matched if they had.
+	// MatchDir and MatchFile called for such entries with source paths that don't exist.
+	Mirror bool
+
+	// Function decides whether a destination entry (with everything below it) should be kept in mirror mode.
+	MirrorProtect func(destPath string) (bool, error)
+
+	// How to find destination files and symlinks that are the same as in source and should not be copied again.
+	// Metadata of such files still updated if differs. Files always copied by default.
+	CompareMethod CompareMethod
+
+	// Hash content of every copied file and read destination file once more after writing to make sure it has the
+	// same hash. Returns ChecksumMismatchError if not. Source is hashed while copied in userspace, otherwise (with
+	// kernel copy methods or when preserving sparse files) it is read once more after copying.
+	VerifyContent bool
+
+	// Function creating hash for content verification. If not defined, then SHA-256 is used.
+	VerifyHash func() hash.Hash
+
+	// Function called periodically with copying progress and once more after copying finished.
+	// Never called concurrently. Not called while planning.
+	Progress func(progress Progress)
+
+	// Minimal interval between Progress calls. If not defined, then DefaultProgressInterval is used.
+	ProgressInterval time.Duration
+
+	// Access destination entries relative to descriptor of destination parent directory without following symlinks,
+	// so that copying never gets outside of destination, even if destination directories replaced with symlinks
+	// concurrently. Uses openat2 with RESOLVE_BENEATH and RESOLVE_NO_SYMLINKS if supported by the kernel, otherwise
+	// opens directories one by one with O_NOFOLLOW. Requires procfs (Linux only).
+	SafeDest bool
+
+	// Destination to write to instead of the local file system, e.g. MemDest. Can't be used with SafeDest.
+	Dest Dest
+}
+
+type hardLinkKey struct {
+	dev uint64
+	ino uint64
+}
+
+// Destination directory metadata that can be set only after all directory entries written.
+type pendingDestDir struct {
+	path string
+
+	setMode bool
+	mode    os.FileMode
+
+	setTimes bool
+	atime    time.Time
+	mtime    time.Time
+}
+
+type hardLink struct {
+	target string
+	// Closed when the target file copied (or failed to copy with err).
+	done chan struct{}
+	err  error
 }
 
 type CopyRecurse struct {
@@ -38,6 +367,101 @@ type CopyRecurse struct {
 
 	abortIfDestParentDirNotExists bool
 
-	// TODO: how memory/CPU-effective is working with this?
-	visitedDestDirs []string
+	copyMethods      []CopyMethod
+	onFileDataCopied func(src, dest string, method CopyMethod)
+
+	preserveHardLinks bool
+	// The first copied file for each hard linked source file.
+	hardLinks   map[hardLinkKey]*hardLink
+	hardLinksMu sync.Mutex
+
+	preserveSparseFiles bool
+
+	preserveTimes bool
+
+	copyXattrs    bool
+	xattrIncludes []string
+	xattrExcludes []string
+	onXattrError  func(path, name string, err error)
+
+	fifoAction        SpecialFileAction
+	charDeviceAction  SpecialFileAction
+	blockDeviceAction SpecialFileAction
+	onSocket          func(src, dest string) error
+
+	symlinks          SymlinkAction
+	maxSymlinkDepth   int
+	escapingSymlinks  EscapingSymlinkAction
+	onEscapingSymlink func(src, linkDestination string, action EscapingSymlinkAction)
+
+	concurrency int
+	// Not nil while running with concurrency.
+	workers *workerPool
+
+	atomicReplace bool
+
+	stageAndSwap bool
+	oldDestPath  string
+
+	compareMethod CompareMethod
+
+	verifyContent bool
+	verifyHash    func() hash.Hash
+
+	mirror        bool
+	mirrorProtect func(destPath string) (bool, error)
+
+	onProgress       func(progress Progress)
+	progressInterval time.Duration
+	// Not nil while running with Progress defined.
+	progress *progressReporter
+
+	safeDest bool
+	// Options.Dest or osDest, replaced with destination root while running with SafeDest.
+	destFS Dest
+
+	// Not nil if created with NewFS, then source paths are names in it.
+	srcFS fs.FS
+
+	result   Result
+	resultMu sync.Mutex
+
+	visitedDestDirs   map[string]struct{}
+	visitedDestDirsMu sync.Mutex
+
+	// Processed in reverse order, so that directories processed after all of their subdirectories.
+	pendingDestDirs []pendingDestDir
+
+	// Destination not changed while planning, actions recorded instead.
+	planning    bool
+	planActions []PlanAction
+	// Directories that would be created, everything below them doesn't exist yet.
+	plannedDirs map[string]struct{}
+}
+
+func (c *CopyRecurse) updateResult(fn func(result *Result)) {
+	c.resultMu.Lock()
+	defer c.resultMu.Unlock()
+
+	fn(&c.result)
+}
+
+func getParentDir(path string) string {
+	return filepath.Dir(filepath.Clean(path))
+}
+
+// Whether path is dir or inside of it.
+func isPathInside(path, dir string) bool {
+	relPath, err := filepath.Rel(dir, path)
+	return err == nil && relPath != ".." && !strings.HasPrefix(relPath, ".."+string(filepath.Separator))
+}
+
+// Same as os.SameFile, but also for entries of MemDest.
+func isSameFile(fileInfo1, fileInfo2 os.FileInfo) bool {
+	if memFileInfo1, ok := fileInfo1.(*memFileInfo); ok {
+		memFileInfo2, ok := fileInfo2.(*memFileInfo)
+		return ok && memFileInfo1.origin == memFileInfo2.origin
+	}
+
+	return os.SameFile(fileInfo1, fileInfo2)
 }
@@ -0,0 +1,74 @@
+package copyrec
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"time"
+)
+
+var errDestNotSupported = errors.New("not supported by destination")
+
+// Destination CopyRecurse writes to, all paths are absolute. Symlinks are never followed, except in path components of
+// the local file system. Operations required by some options only are in optional interfaces, e.g. RenameDest for
+// AtomicReplace, and copying fails if destination doesn't implement them.
+type Dest interface {
+	Lstat(path string) (fs.FileInfo, error)
+	Mkdir(path string, perm fs.FileMode) error
+	// Opens file with os.OpenFile flags, so that file created only with os.O_CREATE.
+	OpenFile(path string, flag int, perm fs.FileMode) (DestFile, error)
+	Symlink(target, path string) error
+	Lchown(path string, uid, gid int) error
+	Chmod(path string, mode fs.FileMode) error
+	// Removes path and everything below it. Missing path is not an error.
+	RemoveAll(path string) error
+}
+
+// File opened in Dest. Kernel copy methods used only if both source and destination files are *os.File.
+type DestFile interface {
+	io.Reader
+	io.Writer
+	io.Closer
+}
+
+// Required for Mirror.
+type ReadDirDest interface {
+	Dest
+	ReadDir(path string) ([]fs.DirEntry, error)
+}
+
+// Required for comparing existing symlinks with CompareMethod.
+type ReadLinkDest interface {
+	Dest
+	Readlink(path string) (string, error)
+}
+
+// Required for AtomicReplace and StageAndSwap.
+type RenameDest interface {
+	Dest
+	Rename(oldPath, newPath string) error
+}
+
+// Required for PreserveHardLinks.
+type LinkDest interface {
+	Dest
+	Link(target, path string) error
+}
+
+// Required for recreating special files. Mode has a type of special file.
+type MknodDest interface {
+	Dest
+	Mknod(path string, mode fs.FileMode, dev uint64) error
+}
+
+// Required for PreserveTimes.
+type ChtimesDest interface {
+	Dest
+	Lchtimes(path string, atime, mtime time.Time) error
+}
+
+// Required for CopyXattrs.
+type XattrDest interface {
+	Dest
+	Lsetxattr(path, name string, value []byte) error
+}
@@ -0,0 +1,327 @@
+//go:build linux
+// +build linux
+
+package copyrec
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Max number of openat2 retries on concurrent renames before falling back to opening path components one by one.
+const maxOpenat2Retries = 16
+
+// Directory opened once, so that entries below it accessed relative to its descriptor without following symlinks and
+// never outside of it, even if some of directories below replaced with symlinks concurrently.
+type destRoot struct {
+	path string
+	fd   int
+}
+
+func openDestRoot(path string) (*destRoot, error) {
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+
+	return &destRoot{path: path, fd: fd}, nil
+}
+
+func (r *destRoot) close() error {
+	return unix.Close(r.fd)
+}
+
+// Opens directory below root with openat2 RESOLVE_BENEATH and RESOLVE_NO_SYMLINKS, or by opening path components one by
+// one with O_NOFOLLOW if openat2 not supported by the kernel, forbidden by seccomp or keeps failing because of
+// concurrent renames.
+func (r *destRoot) openDir(path string, flags int) (int, error) {
+	relPath, err := filepath.Rel(r.path, path)
+	if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return -1, fmt.Errorf("path %q is outside of %q", path, r.path)
+	}
+
+	flags |= unix.O_DIRECTORY | unix.O_CLOEXEC
+
+	for i := 0; i < maxOpenat2Retries; i++ {
+		fd, err := unix.Openat2(r.fd, relPath, &unix.OpenHow{
+			Flags:   uint64(flags),
+			Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_SYMLINKS,
+		})
+		if errors.Is(err, unix.EAGAIN) {
+			// Concurrent rename in the filesystem, the kernel asks to retry.
+			continue
+		} else if errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EPERM) {
+			// Seccomp filters of container runtimes often deny unknown syscalls with EPERM.
+			break
+		} else if err != nil {
+			return -1, &os.PathError{Op: "openat2", Path: path, Err: err}
+		}
+
+		return fd, nil
+	}
+
+	fd, err := unix.Openat(r.fd, ".", unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, &os.PathError{Op: "openat", Path: r.path, Err: err}
+	}
+
+	components := strings.Split(relPath, string(filepath.Separator))
+	for i, component := range components {
+		// Only the last component opened with requested flags, others just walked through.
+		componentFlags := unix.O_PATH | unix.O_DIRECTORY | unix.O_CLOEXEC
+		if i == len(components)-1 {
+			componentFlags = flags
+		}
+
+		nextFd, err := unix.Openat(fd, component, componentFlags|unix.O_NOFOLLOW, 0)
+		unix.Close(fd)
+		if err != nil {
+			return -1, &os.PathError{Op: "openat", Path: filepath.Join(r.path, filepath.Join(components[:i+1]...)), Err: err}
+		}
+
+		fd = nextFd
+	}
+
+	return fd, nil
+}
+
+// Opens parent directory of path and calls fn with its descriptor and base name of path.
+func (r *destRoot) inParentDir(path string, fn func(dirFd int, name string) error) error {
+	if filepath.Clean(path) == r.path {
+		return fmt.Errorf("path %q is not below %q", path, r.path)
+	}
+
+	dirFd, err := r.openDir(getParentDir(path), unix.O_PATH)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dirFd)
+
+	return fn(dirFd, filepath.Base(path))
+}
+
+// Opens path itself, even if it is a symlink, and calls fn with path of the descriptor in procfs. Operations on such a
+// path change the opened entry only and never follow symlinks.
+func (r *destRoot) withProcPath(path string, fn func(procPath string) error) error {
+	return r.inParentDir(path, func(dirFd int, name string) error {
+		fd, err := unix.Openat(dirFd, name, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return &os.PathError{Op: "openat", Path: path, Err: err}
+		}
+		defer unix.Close(fd)
+
+		return fn(fmt.Sprintf("/proc/self/fd/%d", fd))
+	})
+}
+
+func (r *destRoot) Lstat(path string) (os.FileInfo, error) {
+	var fileInfo os.FileInfo
+	err := r.inParentDir(path, func(dirFd int, name string) error {
+		fd, err := unix.Openat(dirFd, name, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return &os.PathError{Op: "lstat", Path: path, Err: err}
+		}
+
+		file := os.NewFile(uintptr(fd), path)
+		defer file.Close()
+
+		fileInfo, err = file.Stat()
+		return err
+	})
+
+	return fileInfo, err
+}
+
+func (r *destRoot) Mkdir(path string, perm os.FileMode) error {
+	return r.inParentDir(path, func(dirFd int, name string) error {
+		if err := unix.Mkdirat(dirFd, name, uint32(perm.Perm())); err != nil {
+			return &os.PathError{Op: "mkdirat", Path: path, Err: err}
+		}
+		return nil
+	})
+}
+
+func (r *destRoot) OpenFile(path string, flag int, perm os.FileMode) (DestFile, error) {
+	var file *os.File
+	err := r.inParentDir(path, func(dirFd int, name string) error {
+		fd, err := unix.Openat(dirFd, name, flag|unix.O_NOFOLLOW|unix.O_CLOEXEC, uint32(perm.Perm()))
+		if err != nil {
+			return &os.PathError{Op: "openat", Path: path, Err: err}
+		}
+
+		file = os.NewFile(uintptr(fd), path)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+func (r *destRoot) Symlink(target, path string) error {
+	return r.inParentDir(path, func(dirFd int, name string) error {
+		if err := unix.Symlinkat(target, dirFd, name); err != nil {
+			return &os.LinkError{Op: "symlinkat", Old: target, New: path, Err: err}
+		}
+		return nil
+	})
+}
+
+func (r *destRoot) Link(target, path string) error {
+	return r.inParentDir(target, func(targetDirFd int, targetName string) error {
+		return r.inParentDir(path, func(dirFd int, name string) error {
+			if err := unix.Linkat(targetDirFd, targetName, dirFd, name, 0); err != nil {
+				return &os.LinkError{Op: "linkat", Old: target, New: path, Err: err}
+			}
+			return nil
+		})
+	})
+}
+
+func (r *destRoot) Mknod(path string, mode os.FileMode, dev uint64) error {
+	return r.inParentDir(path, func(dirFd int, name string) error {
+		if err := unix.Mknodat(dirFd, name, getUnixFileType(mode)|uint32(mode.Perm()), int(dev)); err != nil {
+			return &os.PathError{Op: "mknodat", Path: path, Err: err}
+		}
+		return nil
+	})
+}
+
+func (r *destRoot) Lchown(path string, uid, gid int) error {
+	return r.inParentDir(path, func(dirFd int, name string) error {
+		if err := unix.Fchownat(dirFd, name, uid, gid, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return &os.PathError{Op: "fchownat", Path: path, Err: err}
+		}
+		return nil
+	})
+}
+
+// Fchmodat always follows symlinks, so changing mode through procfs.
+func (r *destRoot) Chmod(path string, mode os.FileMode) error {
+	return r.withProcPath(path, func(procPath string) error {
+		if err := unix.Chmod(procPath, getUnixModeBits(mode)); err != nil {
+			return &os.PathError{Op: "chmod", Path: path, Err: err}
+		}
+		return nil
+	})
+}
+
+func (r *destRoot) remove(path string) error {
+	return r.inParentDir(path, func(dirFd int, name string) error {
+		err := unix.Unlinkat(dirFd, name, 0)
+		if errors.Is(err, unix.EISDIR) {
+			err = unix.Unlinkat(dirFd, name, unix.AT_REMOVEDIR)
+		}
+
+		if err != nil {
+			return &os.PathError{Op: "unlinkat", Path: path, Err: err}
+		}
+		return nil
+	})
+}
+
+func (r *destRoot) RemoveAll(path string) error {
+	fileInfo, err := r.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if fileInfo.IsDir() {
+		entries, err := r.ReadDir(path)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if err := r.RemoveAll(filepath.Join(path, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := r.remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+func (r *destRoot) ReadDir(path string) ([]fs.DirEntry, error) {
+	fd, err := r.openDir(path, unix.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := os.NewFile(uintptr(fd), path)
+	defer dir.Close()
+
+	entries, err := dir.ReadDir(-1)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	return entries, err
+}
+
+func (r *destRoot) Rename(oldPath, newPath string) error {
+	return r.inParentDir(oldPath, func(oldDirFd int, oldName string) error {
+		return r.inParentDir(newPath, func(newDirFd int, newName string) error {
+			if err := unix.Renameat2(oldDirFd, oldName, newDirFd, newName, 0); err != nil {
+				return &os.LinkError{Op: "renameat2", Old: oldPath, New: newPath, Err: err}
+			}
+			return nil
+		})
+	})
+}
+
+func (r *destRoot) exchange(path1, path2 string) error {
+	return r.inParentDir(path1, func(dirFd1 int, name1 string) error {
+		return r.inParentDir(path2, func(dirFd2 int, name2 string) error {
+			return exchangePathsAt(dirFd1, name1, dirFd2, name2)
+		})
+	})
+}
+
+func (r *destRoot) Readlink(path string) (string, error) {
+	var linkDestination string
+	err := r.inParentDir(path, func(dirFd int, name string) error {
+		for size := 128; ; size *= 2 {
+			buf := make([]byte, size)
+			n, err := unix.Readlinkat(dirFd, name, buf)
+			if err != nil {
+				return &os.PathError{Op: "readlinkat", Path: path, Err: err}
+			} else if n < size {
+				linkDestination = string(buf[:n])
+				return nil
+			}
+		}
+	})
+
+	return linkDestination, err
+}
+
+func (r *destRoot) Lchtimes(path string, atime, mtime time.Time) error {
+	return r.inParentDir(path, func(dirFd int, name string) error {
+		times := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+		if err := unix.UtimesNanoAt(dirFd, name, times, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return &os.PathError{Op: "utimensat", Path: path, Err: err}
+		}
+		return nil
+	})
+}
+
+// Lsetxattr can't be called relative to a descriptor, so setting attribute through procfs.
+func (r *destRoot) Lsetxattr(path, name string, value []byte) error {
+	return r.withProcPath(path, func(procPath string) error {
+		return unix.Setxattr(procPath, name, value, 0)
+	})
+}
@@ -0,0 +1,254 @@
+//go:build linux
+// +build linux
+
+package copyrec
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Max number of bytes copied by a single copy_file_range/sendfile call.
+const maxKernelCopyChunk = 1 << 30
+
+// Copies length bytes from the current offset of srcFile to the current offset of destFile. Reflink always clones
+// the whole file.
+func copyFileDataWithMethod(method CopyMethod, srcFile, destFile *os.File, length int64) error {
+	switch method {
+	case CopyMethodReflink:
+		if err := unix.IoctlFileClone(int(destFile.Fd()), int(srcFile.Fd())); isKernelCopyNotSupportedErr(err) {
+			return fmt.Errorf("%w: %s", errCopyMethodNotSupported, err)
+		} else if err != nil {
+			return fmt.Errorf("error cloning file: %w", err)
+		}
+		return nil
+	case CopyMethodCopyFileRange:
+		return copyFileDataInKernel(length, func(chunk int) (int, error) {
+			return unix.CopyFileRange(int(srcFile.Fd()), nil, int(destFile.Fd()), nil, chunk, 0)
+		})
+	case CopyMethodSendfile:
+		return copyFileDataInKernel(length, func(chunk int) (int, error) {
+			return unix.Sendfile(int(destFile.Fd()), int(srcFile.Fd()), nil, chunk)
+		})
+	case CopyMethodUserspace:
+		return copyFileDataInUserspace(io.LimitReader(srcFile, length), destFile)
+	default:
+		return fmt.Errorf("%w: unknown copy method %s", errCopyMethodNotSupported, method)
+	}
+}
+
+// Calls copyChunk until length bytes copied or EOF reached. Falls back (returns errCopyMethodNotSupported) only if
+// nothing was copied yet.
+func copyFileDataInKernel(length int64, copyChunk func(chunk int) (int, error)) error {
+	var written int64
+	for written < length {
+		chunk := length - written
+		if chunk > maxKernelCopyChunk {
+			chunk = maxKernelCopyChunk
+		}
+
+		n, err := copyChunk(int(chunk))
+		if errors.Is(err, unix.EINTR) {
+			continue
+		} else if err != nil {
+			if written == 0 && isKernelCopyNotSupportedErr(err) {
+				return fmt.Errorf("%w: %s", errCopyMethodNotSupported, err)
+			}
+			return err
+		}
+
+		if n == 0 {
+			// Some special files (e.g. in procfs) report EOF right away while having data.
+			if written == 0 {
+				return fmt.Errorf("%w: no data copied", errCopyMethodNotSupported)
+			}
+			return nil
+		}
+
+		written += int64(n)
+	}
+
+	return nil
+}
+
+// Copies only data regions of srcFile, leaving holes in destFile. Reflink clones the whole file, holes included.
+func copySparseFileDataWithMethod(method CopyMethod, srcFile, destFile *os.File, size int64) error {
+	if method == CopyMethodReflink {
+		return copyFileDataWithMethod(method, srcFile, destFile, size)
+	}
+
+	srcFd := int(srcFile.Fd())
+
+	var offset int64
+	for offset < size {
+		dataStart, err := unix.Seek(srcFd, offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			// Only a hole left till the end of file.
+			break
+		} else if offset == 0 && (errors.Is(err, unix.EINVAL) || errors.Is(err, unix.EOPNOTSUPP)) {
+			// SEEK_DATA not supported, copying the whole file.
+			return copyFileDataWithMethod(method, srcFile, destFile, size)
+		} else if err != nil {
+			return fmt.Errorf("error seeking next data region from offset %d: %w", offset, err)
+		}
+
+		if dataStart >= size {
+			break
+		}
+
+		holeStart, err := unix.Seek(srcFd, dataStart, unix.SEEK_HOLE)
+		if err != nil {
+			return fmt.Errorf("error seeking next hole from offset %d: %w", dataStart, err)
+		}
+
+		if holeStart > size {
+			holeStart = size
+		}
+
+		if _, err := srcFile.Seek(dataStart, io.SeekStart); err != nil {
+			return fmt.Errorf("error seeking source file to offset %d: %w", dataStart, err)
+		}
+
+		if _, err := destFile.Seek(dataStart, io.SeekStart); err != nil {
+			return fmt.Errorf("error seeking destination file to offset %d: %w", dataStart, err)
+		}
+
+		if err := copyFileDataWithMethod(method, srcFile, destFile, holeStart-dataStart); errors.Is(err, errCopyMethodNotSupported) && offset > 0 {
+			return fmt.Errorf("error copying data region at offset %d: %s", dataStart, err)
+		} else if err != nil {
+			return err
+		}
+
+		offset = holeStart
+	}
+
+	if err := destFile.Truncate(size); err != nil {
+		return fmt.Errorf("error truncating destination file to size %d: %w", size, err)
+	}
+
+	return nil
+}
+
+// Utimensat with NULL path changes the file referred by descriptor, x/sys/unix has no wrapper for it.
+func futimens(file *os.File, atime, mtime time.Time) error {
+	times := [2]unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+	_, _, errno := unix.Syscall6(unix.SYS_UTIMENSAT, file.Fd(), 0, uintptr(unsafe.Pointer(&times[0])), 0, 0, 0)
+	runtime.KeepAlive(file)
+	if errno != 0 {
+		return &os.PathError{Op: "futimens", Path: file.Name(), Err: errno}
+	}
+
+	return nil
+}
+
+func getAtime(fileInfo os.FileInfo) time.Time {
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileInfo.ModTime()
+	}
+
+	return time.Unix(stat.Atim.Unix())
+}
+
+var errXattrNotFound = unix.ENODATA
+
+func listXattrs(path string) ([]string, error) {
+	for {
+		size, err := unix.Llistxattr(path, nil)
+		if err != nil {
+			return nil, err
+		} else if size == 0 {
+			return nil, nil
+		}
+
+		buf := make([]byte, size)
+		size, err = unix.Llistxattr(path, buf)
+		if errors.Is(err, unix.ERANGE) {
+			// Attributes added after getting the size.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		var names []string
+		for _, name := range strings.Split(string(buf[:size]), "\x00") {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+
+		return names, nil
+	}
+}
+
+func getXattr(path, name string) ([]byte, error) {
+	for {
+		size, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, size)
+		size, err = unix.Lgetxattr(path, name, buf)
+		if errors.Is(err, unix.ERANGE) {
+			// Attribute value changed after getting the size.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		return buf[:size], nil
+	}
+}
+
+func setXattr(path, name string, value []byte) error {
+	return unix.Lsetxattr(path, name, value, 0)
+}
+
+// Errors returned if extended attributes (or some namespace of them) not supported or not permitted for the path.
+func isXattrNotSupportedErr(err error) bool {
+	return errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES)
+}
+
+// Writes file data to storage and evicts it from page cache.
+func dropFileCache(file *os.File) error {
+	if err := file.Sync(); err != nil {
+		return err
+	}
+
+	return unix.Fadvise(int(file.Fd()), 0, 0, unix.FADV_DONTNEED)
+}
+
+// Atomically exchanges two existing paths with renameat2(RENAME_EXCHANGE).
+func exchangePaths(path1, path2 string) error {
+	return exchangePathsAt(unix.AT_FDCWD, path1, unix.AT_FDCWD, path2)
+}
+
+func exchangePathsAt(dirFd1 int, path1 string, dirFd2 int, path2 string) error {
+	if err := unix.Renameat2(dirFd1, path1, dirFd2, path2, unix.RENAME_EXCHANGE); errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EOPNOTSUPP) {
+		return fmt.Errorf("%w: %s", errExchangeNotSupported, err)
+	} else if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func isKernelCopyNotSupportedErr(err error) bool {
+	return errors.Is(err, unix.EOPNOTSUPP) ||
+		errors.Is(err, unix.ENOTTY) ||
+		errors.Is(err, unix.ENOSYS) ||
+		errors.Is(err, unix.EXDEV) ||
+		errors.Is(err, unix.EINVAL) ||
+		errors.Is(err, unix.EBADF) ||
+		errors.Is(err, unix.EPERM)
+}
@@ -0,0 +1,464 @@
+package copyrec
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Ready to use Options.MatchDir and Options.MatchFile functions. Work with both absolute paths passed by New and
+// names in fs.FS passed by NewFS, src should be the same as the source or root passed to them.
+type Matchers struct {
+	MatchDir  func(path string) (DirAction, error)
+	MatchFile func(path string) (bool, error)
+}
+
+// NewDockerignoreMatchers returns matchers for paths inside src not excluded by patterns in .dockerignore syntax.
+// Pattern matching a directory matches everything below it, but files below can still be re-included with "!".
+func NewDockerignoreMatchers(src string, dockerignore io.Reader) (*Matchers, error) {
+	var patterns []ignorePattern
+
+	scanner := bufio.NewScanner(dockerignore)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var pattern ignorePattern
+		if strings.HasPrefix(line, "!") {
+			pattern.negate = true
+			line = strings.TrimSpace(line[1:])
+		}
+
+		line = strings.TrimPrefix(filepath.ToSlash(filepath.Clean(line)), "/")
+		if line == "." {
+			continue
+		}
+
+		pattern.segments = strings.Split(line, "/")
+		patterns = append(patterns, pattern)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading .dockerignore: %w", err)
+	}
+
+	return newIgnoreMatchers(src, patterns, false)
+}
+
+// NewGitignoreMatchers returns matchers for paths inside src not ignored by patterns in .gitignore syntax.
+// Only patterns of a single .gitignore file in src are supported. As in git, files below ignored directory can't be
+// re-included with "!".
+func NewGitignoreMatchers(src string, gitignore io.Reader) (*Matchers, error) {
+	var patterns []ignorePattern
+
+	scanner := bufio.NewScanner(gitignore)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// Trailing spaces ignored unless escaped with backslash.
+		for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+			line = line[:len(line)-1]
+		}
+
+		var pattern ignorePattern
+		if strings.HasPrefix(line, "!") {
+			pattern.negate = true
+			line = line[1:]
+		}
+
+		if strings.HasSuffix(line, "/") {
+			pattern.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+
+		if line == "" {
+			continue
+		}
+
+		// Pattern without slashes (except trailing one) matches at any level, otherwise relative to src.
+		anchored := strings.Contains(line, "/")
+		pattern.segments = strings.Split(strings.TrimPrefix(line, "/"), "/")
+		if !anchored {
+			pattern.segments = append([]string{"**"}, pattern.segments...)
+		}
+
+		patterns = append(patterns, pattern)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading .gitignore: %w", err)
+	}
+
+	return newIgnoreMatchers(src, patterns, true)
+}
+
+// NewGlobMatchers returns matchers for paths inside src matching any of include patterns (or any paths if there are no
+// include patterns) and none of exclude patterns. Patterns are relative to src in path.Match syntax extended with "**"
+// matching any number of directories and "{a,b}" alternatives. Pattern matching a directory matches everything below it.
+func NewGlobMatchers(src string, includes, excludes []string) (*Matchers, error) {
+	absSrc, err := filepath.Abs(src)
+	if err != nil {
+		return nil, fmt.Errorf("error getting absolute path for src %q: %w", src, err)
+	}
+
+	matcher := &globMatcher{src: filepath.Clean(src), absSrc: absSrc}
+
+	if matcher.includes, err = compileGlobPatterns(includes); err != nil {
+		return nil, fmt.Errorf("error compiling include patterns: %w", err)
+	}
+
+	if matcher.excludes, err = compileGlobPatterns(excludes); err != nil {
+		return nil, fmt.Errorf("error compiling exclude patterns: %w", err)
+	}
+
+	return &Matchers{
+		MatchDir:  matcher.matchDir,
+		MatchFile: matcher.matchFile,
+	}, nil
+}
+
+type globMatcher struct {
+	src      string
+	absSrc   string
+	includes [][]string
+	excludes [][]string
+}
+
+func (m *globMatcher) matchDir(path string) (DirAction, error) {
+	segments, err := getRelPathSegments(m.src, m.absSrc, path)
+	if err != nil {
+		return 0, err
+	}
+
+	if matchAnyGlob(m.excludes, segments) {
+		return DirSkip, nil
+	}
+
+	if len(m.includes) == 0 || matchAnyGlob(m.includes, segments) {
+		if canMatchAnyGlobBelow(m.excludes, segments) {
+			return DirFallThrough, nil
+		}
+		return DirMatch, nil
+	}
+
+	if canMatchAnyGlobBelow(m.includes, segments) {
+		return DirFallThrough, nil
+	}
+	return DirSkip, nil
+}
+
+func (m *globMatcher) matchFile(path string) (bool, error) {
+	segments, err := getRelPathSegments(m.src, m.absSrc, path)
+	if err != nil {
+		return false, err
+	}
+
+	return (len(m.includes) == 0 || matchAnyGlob(m.includes, segments)) && !matchAnyGlob(m.excludes, segments), nil
+}
+
+func compileGlobPatterns(patterns []string) ([][]string, error) {
+	var compiled [][]string
+	for _, pattern := range patterns {
+		for _, expandedPattern := range expandGlobBraces(pattern) {
+			segments := strings.Split(strings.TrimPrefix(path.Clean(filepath.ToSlash(expandedPattern)), "/"), "/")
+			if err := validateGlobSegments(segments); err != nil {
+				return nil, err
+			}
+
+			compiled = append(compiled, segments)
+
+			// Trailing "**" matches at least one segment, so matching the directory itself separately.
+			if len(segments) > 1 && segments[len(segments)-1] == "**" {
+				compiled = append(compiled, segments[:len(segments)-1])
+			}
+		}
+	}
+
+	return compiled, nil
+}
+
+// Expands "{a,b}" alternatives (possibly nested) into separate patterns.
+func expandGlobBraces(pattern string) []string {
+	start := -1
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] == '\\' {
+			i++
+		} else if pattern[i] == '{' {
+			start = i
+			break
+		}
+	}
+
+	if start == -1 {
+		return []string{pattern}
+	}
+
+	var alternatives []string
+	depth, altStart := 0, start+1
+	for i := start + 1; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case '{':
+			depth++
+		case ',':
+			if depth == 0 {
+				alternatives = append(alternatives, pattern[altStart:i])
+				altStart = i + 1
+			}
+		case '}':
+			if depth > 0 {
+				depth--
+				continue
+			}
+
+			alternatives = append(alternatives, pattern[altStart:i])
+
+			var expanded []string
+			for _, alternative := range alternatives {
+				expanded = append(expanded, expandGlobBraces(pattern[:start]+alternative+pattern[i+1:])...)
+			}
+			return expanded
+		}
+	}
+
+	// Unclosed brace matched literally.
+	return []string{pattern}
+}
+
+// Whether any of patterns matches the path or any of its parent directories.
+func matchAnyGlob(patterns [][]string, segments []string) bool {
+	for _, pattern := range patterns {
+		for i := len(segments); i > 0; i-- {
+			if matchGlobSegments(pattern, segments[:i]) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func canMatchAnyGlobBelow(patterns [][]string, dirSegments []string) bool {
+	for _, pattern := range patterns {
+		if canMatchGlobBelow(pattern, dirSegments) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type ignorePattern struct {
+	segments []string
+	negate   bool
+	dirOnly  bool
+}
+
+// If matchParents is true, then pattern matching any of parent directories matches the path too.
+func (p ignorePattern) matches(segments []string, isDir, matchParents bool) bool {
+	if (!p.dirOnly || isDir) && matchGlobSegments(p.segments, segments) {
+		return true
+	}
+
+	if matchParents {
+		for i := len(segments) - 1; i > 0; i-- {
+			if matchGlobSegments(p.segments, segments[:i]) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+type ignoreMatcher struct {
+	src      string
+	absSrc   string
+	patterns []ignorePattern
+	// Files below ignored directory can't be re-included.
+	gitignore bool
+}
+
+func newIgnoreMatchers(src string, patterns []ignorePattern, gitignore bool) (*Matchers, error) {
+	for _, pattern := range patterns {
+		if err := validateGlobSegments(pattern.segments); err != nil {
+			return nil, err
+		}
+	}
+
+	absSrc, err := filepath.Abs(src)
+	if err != nil {
+		return nil, fmt.Errorf("error getting absolute path for src %q: %w", src, err)
+	}
+
+	matcher := &ignoreMatcher{
+		src:       filepath.Clean(src),
+		absSrc:    absSrc,
+		patterns:  patterns,
+		gitignore: gitignore,
+	}
+
+	return &Matchers{
+		MatchDir:  matcher.matchDir,
+		MatchFile: matcher.matchFile,
+	}, nil
+}
+
+func (m *ignoreMatcher) matchDir(path string) (DirAction, error) {
+	segments, err := getRelPathSegments(m.src, m.absSrc, path)
+	if err != nil {
+		return 0, err
+	}
+
+	if m.isIgnored(segments, true) {
+		if m.canMatchBelow(segments, true) {
+			return DirFallThrough, nil
+		}
+		return DirSkip, nil
+	}
+
+	if m.canMatchBelow(segments, false) {
+		return DirFallThrough, nil
+	}
+	return DirMatch, nil
+}
+
+func (m *ignoreMatcher) matchFile(path string) (bool, error) {
+	segments, err := getRelPathSegments(m.src, m.absSrc, path)
+	if err != nil {
+		return false, err
+	}
+
+	return !m.isIgnored(segments, false), nil
+}
+
+func (m *ignoreMatcher) isIgnored(segments []string, isDir bool) bool {
+	if len(segments) == 0 {
+		return false
+	}
+
+	if m.gitignore {
+		for i := 1; i < len(segments); i++ {
+			if m.matchPatterns(segments[:i], true) {
+				return true
+			}
+		}
+	}
+
+	return m.matchPatterns(segments, isDir)
+}
+
+// The last matching pattern decides whether path ignored.
+func (m *ignoreMatcher) matchPatterns(segments []string, isDir bool) bool {
+	var ignored bool
+	for _, pattern := range m.patterns {
+		if pattern.matches(segments, isDir, !m.gitignore) {
+			ignored = !pattern.negate
+		}
+	}
+
+	return ignored
+}
+
+func (m *ignoreMatcher) canMatchBelow(dirSegments []string, negate bool) bool {
+	for _, pattern := range m.patterns {
+		if pattern.negate == negate && canMatchGlobBelow(pattern.segments, dirSegments) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Path relative to base split into segments, nil for base itself.
+// Names in fs.FS are relative to its root, while paths on disk are absolute, so they are relative to src or absSrc.
+func getRelPathSegments(src, absSrc, p string) ([]string, error) {
+	base := absSrc
+	if !filepath.IsAbs(p) {
+		base = src
+	}
+
+	relPath, err := filepath.Rel(base, p)
+	if err != nil {
+		return nil, fmt.Errorf("error calculating relative path for base %q and target %q: %w", base, p, err)
+	}
+
+	if relPath == "." {
+		return nil, nil
+	}
+
+	if relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("path %q is outside of %q", p, base)
+	}
+
+	return strings.Split(filepath.ToSlash(relPath), "/"), nil
+}
+
+func validateGlobSegments(pattern []string) error {
+	for _, segment := range pattern {
+		if _, err := path.Match(segment, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", strings.Join(pattern, "/"), err)
+		}
+	}
+
+	return nil
+}
+
+// Segments matched with path.Match, except "**" matching any number of segments, but at least one at the end of pattern.
+func matchGlobSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+
+	if pattern[0] == "**" {
+		if len(pattern) == 1 {
+			return len(segments) > 0
+		}
+
+		for i := 0; i <= len(segments); i++ {
+			if matchGlobSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(segments) == 0 {
+		return false
+	}
+
+	if matched, _ := path.Match(pattern[0], segments[0]); !matched {
+		return false
+	}
+
+	return matchGlobSegments(pattern[1:], segments[1:])
+}
+
+// Whether pattern can match any path below the directory, not the directory itself.
+func canMatchGlobBelow(pattern, dirSegments []string) bool {
+	if len(dirSegments) == 0 {
+		return len(pattern) > 0
+	}
+
+	if len(pattern) == 0 {
+		return false
+	}
+
+	if pattern[0] == "**" {
+		// Either matches none of the rest of directory segments or at least one of them.
+		return canMatchGlobBelow(pattern[1:], dirSegments) || canMatchGlobBelow(pattern, dirSegments[1:])
+	}
+
+	if matched, _ := path.Match(pattern[0], dirSegments[0]); !matched {
+		return false
+	}
+
+	return canMatchGlobBelow(pattern[1:], dirSegments[1:])
+}
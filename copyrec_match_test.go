@@ -0,0 +1,202 @@
+package copyrec_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing/fstest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	copyrec "github.com/werf/copy-recurse"
+)
+
+var _ = Describe("Matchers", func() {
+	const src = "/src"
+
+	DescribeTable(".dockerignore file matching",
+		func(dockerignore, path string, expected bool) {
+			matchers, err := copyrec.NewDockerignoreMatchers(src, strings.NewReader(dockerignore))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(matchers.MatchFile(filepath.Join(src, path))).To(Equal(expected))
+		},
+		Entry("not ignored file", "*.log", "file.txt", true),
+		Entry("ignored file", "*.log", "file.log", false),
+		Entry("pattern anchored to src", "*.log", "dir/file.log", true),
+		Entry("double star matching any dirs", "**/*.log", "dir/subdir/file.log", false),
+		Entry("double star matching no dirs", "**/*.log", "file.log", false),
+		Entry("file inside ignored dir", "dir", "dir/subdir/file", false),
+		Entry("file re-included inside ignored dir", "dir\n!dir/keep", "dir/keep", true),
+		Entry("the last matching pattern", "!file\nfile", "file", false),
+		Entry("leading slash", "/dir/file", "dir/file", false),
+		Entry("comments and blank lines", "# file\n\n  ", "file", true),
+	)
+
+	DescribeTable(".dockerignore dir matching",
+		func(dockerignore, path string, expected copyrec.DirAction) {
+			matchers, err := copyrec.NewDockerignoreMatchers(src, strings.NewReader(dockerignore))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(matchers.MatchDir(filepath.Join(src, path))).To(Equal(expected))
+		},
+		Entry("ignored dir", "dir", "dir", copyrec.DirSkip),
+		Entry("dir inside ignored dir", "dir", "dir/subdir", copyrec.DirSkip),
+		Entry("ignored dir with re-included file below", "dir\n!dir/subdir/keep", "dir", copyrec.DirFallThrough),
+		Entry("ignored dir with re-included file at any level", "dir\n!**/keep", "dir", copyrec.DirFallThrough),
+		Entry("re-included dir", "dir\n!dir/subdir", "dir/subdir", copyrec.DirMatch),
+		Entry("dir with ignored file below", "dir/*.log", "dir", copyrec.DirFallThrough),
+		Entry("dir with ignored files at any level", "**/*.log", "dir/subdir", copyrec.DirFallThrough),
+		Entry("dir without ignored files below", "dir/*.log", "other", copyrec.DirMatch),
+	)
+
+	DescribeTable(".gitignore file matching",
+		func(gitignore, path string, expected bool) {
+			matchers, err := copyrec.NewGitignoreMatchers(src, strings.NewReader(gitignore))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(matchers.MatchFile(filepath.Join(src, path))).To(Equal(expected))
+		},
+		Entry("pattern without slash at any level", "*.log", "dir/file.log", false),
+		Entry("pattern with slash anchored to src", "dir/*.log", "other/dir/file.log", true),
+		Entry("pattern with leading slash anchored to src", "/file", "dir/file", true),
+		Entry("dir only pattern not matching file", "build/", "build", true),
+		Entry("file inside dir matched by dir only pattern", "build/", "dir/build/file", false),
+		Entry("file can't be re-included inside ignored dir", "dir\n!dir/keep", "dir/keep", false),
+		Entry("file re-included", "*.log\n!keep.log", "keep.log", true),
+		Entry("trailing double star", "dir/**", "dir/subdir/file", false),
+		Entry("double star in the middle", "a/**/b", "a/x/y/b", false),
+		Entry("double star in the middle matching no dirs", "a/**/b", "a/b", false),
+		Entry("escaped hash", "\\#file", "#file", false),
+		Entry("trailing spaces", "file  ", "file", false),
+	)
+
+	DescribeTable(".gitignore dir matching",
+		func(gitignore, path string, expected copyrec.DirAction) {
+			matchers, err := copyrec.NewGitignoreMatchers(src, strings.NewReader(gitignore))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(matchers.MatchDir(filepath.Join(src, path))).To(Equal(expected))
+		},
+		Entry("ignored dir", "build/", "dir/build", copyrec.DirSkip),
+		Entry("dir with trailing double star not ignored itself", "dir/**\n!dir/keep", "dir", copyrec.DirFallThrough),
+		Entry("dir with ignored files at any level", "*.log", "dir", copyrec.DirFallThrough),
+		Entry("dir without ignored files below", "/dir/*.log", "other", copyrec.DirMatch),
+	)
+
+	DescribeTable("glob file matching",
+		func(includes, excludes []string, path string, expected bool) {
+			matchers, err := copyrec.NewGlobMatchers(src, includes, excludes)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(matchers.MatchFile(filepath.Join(src, path))).To(Equal(expected))
+		},
+		Entry("no patterns", nil, nil, "file", true),
+		Entry("included file", []string{"*.go"}, nil, "main.go", true),
+		Entry("not included file", []string{"*.go"}, nil, "README.md", false),
+		Entry("file inside included dir", []string{"dir"}, nil, "dir/subdir/file", true),
+		Entry("double star matching any dirs", []string{"**/*.go"}, nil, "a/b/main.go", true),
+		Entry("double star matching no dirs", []string{"**/*.go"}, nil, "main.go", true),
+		Entry("trailing double star", []string{"dir/**"}, nil, "dir/file", true),
+		Entry("braces", []string{"*.{go,mod}"}, nil, "go.mod", true),
+		Entry("nested braces", []string{"{a,b/{c,d}}/file"}, nil, "b/d/file", true),
+		Entry("excluded file", nil, []string{"*_test.go"}, "main_test.go", false),
+		Entry("exclude taking precedence", []string{"**/*.go"}, []string{"**/*_test.go"}, "dir/main_test.go", false),
+		Entry("file inside excluded dir", []string{"**"}, []string{"vendor"}, "vendor/pkg/file", false),
+	)
+
+	DescribeTable("glob dir matching",
+		func(includes, excludes []string, path string, expected copyrec.DirAction) {
+			matchers, err := copyrec.NewGlobMatchers(src, includes, excludes)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(matchers.MatchDir(filepath.Join(src, path))).To(Equal(expected))
+		},
+		Entry("no patterns", nil, nil, "dir", copyrec.DirMatch),
+		Entry("included dir", []string{"dir"}, nil, "dir", copyrec.DirMatch),
+		Entry("dir matched by trailing double star", []string{"dir/**"}, nil, "dir", copyrec.DirMatch),
+		Entry("dir inside included dir", []string{"dir"}, nil, "dir/subdir", copyrec.DirMatch),
+		Entry("parent of included dir", []string{"a/b"}, nil, "a", copyrec.DirFallThrough),
+		Entry("dir with included files at any level", []string{"**/*.go"}, nil, "dir", copyrec.DirFallThrough),
+		Entry("dir without included files below", []string{"a/*.go"}, nil, "b", copyrec.DirSkip),
+		Entry("excluded dir", nil, []string{"vendor"}, "vendor", copyrec.DirSkip),
+		Entry("dir matched by excluded braces", nil, []string{"{vendor,node_modules}"}, "node_modules", copyrec.DirSkip),
+		Entry("included dir with excluded files below", []string{"dir"}, []string{"dir/*.log"}, "dir", copyrec.DirFallThrough),
+		Entry("included dir without excluded files below", []string{"dir"}, []string{"other/*.log"}, "dir", copyrec.DirMatch),
+	)
+
+	It("should fail for invalid glob pattern", func() {
+		_, err := copyrec.NewGlobMatchers(src, []string{"[a-"}, nil)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should fail for invalid pattern", func() {
+		_, err := copyrec.NewGitignoreMatchers(src, strings.NewReader("[a-"))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should fail for path outside of src", func() {
+		matchers, err := copyrec.NewDockerignoreMatchers(src, strings.NewReader("*.log"))
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = matchers.MatchFile("/other/file")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should copy files not excluded by .dockerignore", func() {
+		tmpRoot, err := os.MkdirTemp("", "*-copyrec-test")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tmpRoot)
+
+		tmpSrc := filepath.Join(tmpRoot, "src")
+		tmpDest := filepath.Join(tmpRoot, "dest")
+
+		Expect(os.MkdirAll(filepath.Join(tmpSrc, "empty"), 0o755)).To(Succeed())
+		for _, path := range []string{"file", "file.log", "node_modules/pkg/index.js", "node_modules/keep/index.js"} {
+			Expect(os.MkdirAll(filepath.Dir(filepath.Join(tmpSrc, path)), 0o755)).To(Succeed())
+			touchFile(filepath.Join(tmpSrc, path))
+		}
+
+		matchers, err := copyrec.NewDockerignoreMatchers(tmpSrc, strings.NewReader("*.log\nnode_modules\n!node_modules/keep"))
+		Expect(err).ToNot(HaveOccurred())
+
+		copyRec, err := copyrec.New(tmpSrc, tmpDest, copyrec.Options{
+			MatchDir:  matchers.MatchDir,
+			MatchFile: matchers.MatchFile,
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(copyRec.Run(context.Background())).To(Succeed())
+
+		Expect(filepath.Join(tmpDest, "file")).To(BeARegularFile())
+		Expect(filepath.Join(tmpDest, "empty")).To(BeADirectory())
+		Expect(filepath.Join(tmpDest, "node_modules", "keep", "index.js")).To(BeARegularFile())
+		Expect(filepath.Join(tmpDest, "file.log")).ToNot(BeAnExistingFile())
+		Expect(filepath.Join(tmpDest, "node_modules", "pkg")).ToNot(BeAnExistingFile())
+	})
+
+	It("should copy files of fs.FS not excluded by .dockerignore", func() {
+		fsys := fstest.MapFS{
+			"root/file":                       {Data: []byte("file")},
+			"root/file.log":                   {Data: []byte("log")},
+			"root/node_modules/pkg/index.js":  {Data: []byte("pkg")},
+			"root/node_modules/keep/index.js": {Data: []byte("keep")},
+		}
+
+		matchers, err := copyrec.NewDockerignoreMatchers("root", strings.NewReader("*.log\nnode_modules\n!node_modules/keep"))
+		Expect(err).ToNot(HaveOccurred())
+
+		memDest := copyrec.NewMemDest()
+		copyRec, err := copyrec.NewFS(fsys, "root", "/dest", copyrec.Options{
+			Dest:      memDest,
+			MatchDir:  matchers.MatchDir,
+			MatchFile: matchers.MatchFile,
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(copyRec.Run(context.Background())).To(Succeed())
+		Expect(memDest.Paths()).To(Equal([]string{"/", "/dest", "/dest/file", "/dest/node_modules", "/dest/node_modules/keep", "/dest/node_modules/keep/index.js"}))
+	})
+})
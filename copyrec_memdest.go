@@ -0,0 +1,441 @@
+package copyrec
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// In-memory destination, e.g. for testing matchers without touching disk. Initially only the root directory exists.
+type MemDest struct {
+	mu      sync.Mutex
+	entries map[string]*MemEntry
+}
+
+// Entry of MemDest. Hard links share the same entry.
+type MemEntry struct {
+	Mode fs.FileMode
+	UID  int
+	GID  int
+	// Content of a regular file.
+	Data []byte
+	// Destination of a symlink.
+	Target string
+	// Device number of a device file.
+	Dev     uint64
+	Atime   time.Time
+	ModTime time.Time
+	Xattrs  map[string][]byte
+}
+
+func NewMemDest() *MemDest {
+	now := time.Now()
+	return &MemDest{
+		entries: map[string]*MemEntry{
+			string(filepath.Separator): {Mode: fs.ModeDir | 0o755, UID: os.Geteuid(), GID: os.Getegid(), Atime: now, ModTime: now},
+		},
+	}
+}
+
+// Returns a copy of entry at path.
+func (d *MemDest) Entry(path string) (MemEntry, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entry, ok := d.entries[filepath.Clean(path)]
+	if !ok {
+		return MemEntry{}, false
+	}
+
+	return entry.copy(), true
+}
+
+// Returns sorted paths of all entries, the root directory included.
+func (d *MemDest) Paths() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	paths := make([]string, 0, len(d.entries))
+	for path := range d.entries {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	return paths
+}
+
+func (d *MemDest) Lstat(path string) (fs.FileInfo, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entry, err := d.lookup("lstat", path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &memFileInfo{name: filepath.Base(path), entry: entry.copy(), origin: entry}, nil
+}
+
+func (d *MemDest) Mkdir(path string, perm fs.FileMode) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.create("mkdir", path, &MemEntry{Mode: fs.ModeDir | perm.Perm()})
+}
+
+func (d *MemDest) OpenFile(path string, flag int, perm fs.FileMode) (DestFile, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entry, err := d.lookup("open", path)
+	switch {
+	case err == nil && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: path, Err: fs.ErrExist}
+	case err == nil && !entry.Mode.IsRegular():
+		return nil, &fs.PathError{Op: "open", Path: path, Err: fs.ErrInvalid}
+	case err == nil:
+		if flag&os.O_TRUNC != 0 {
+			entry.Data = nil
+		}
+	case flag&os.O_CREATE != 0:
+		entry = &MemEntry{Mode: perm.Perm()}
+		if err := d.create("open", path, entry); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	return &memFile{dest: d, entry: entry}, nil
+}
+
+func (d *MemDest) Symlink(target, path string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.create("symlink", path, &MemEntry{Mode: fs.ModeSymlink | fs.ModePerm, Target: target})
+}
+
+func (d *MemDest) Lchown(path string, uid, gid int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entry, err := d.lookup("lchown", path)
+	if err != nil {
+		return err
+	}
+
+	entry.UID, entry.GID = uid, gid
+
+	return nil
+}
+
+func (d *MemDest) Chmod(path string, mode fs.FileMode) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entry, err := d.lookup("chmod", path)
+	if err != nil {
+		return err
+	}
+
+	entry.Mode = entry.Mode.Type() | mode&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)
+
+	return nil
+}
+
+func (d *MemDest) RemoveAll(path string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, entryPath := range d.pathsBelow(path) {
+		delete(d.entries, entryPath)
+	}
+
+	return nil
+}
+
+func (d *MemDest) ReadDir(path string) ([]fs.DirEntry, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if entry, err := d.lookup("readdir", path); err != nil {
+		return nil, err
+	} else if !entry.Mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: path, Err: syscall.ENOTDIR}
+	}
+
+	var dirEntries []fs.DirEntry
+	for entryPath, entry := range d.entries {
+		if entryPath != filepath.Clean(path) && getParentDir(entryPath) == filepath.Clean(path) {
+			dirEntries = append(dirEntries, fs.FileInfoToDirEntry(&memFileInfo{name: filepath.Base(entryPath), entry: entry.copy(), origin: entry}))
+		}
+	}
+	sort.Slice(dirEntries, func(i, j int) bool { return dirEntries[i].Name() < dirEntries[j].Name() })
+
+	return dirEntries, nil
+}
+
+func (d *MemDest) Readlink(path string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entry, err := d.lookup("readlink", path)
+	if err != nil {
+		return "", err
+	} else if entry.Mode&fs.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: path, Err: fs.ErrInvalid}
+	}
+
+	return entry.Target, nil
+}
+
+// Replaces newPath like rename syscall does, i.e. a directory can replace only an empty directory.
+func (d *MemDest) Rename(oldPath, newPath string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	oldPath, newPath = filepath.Clean(oldPath), filepath.Clean(newPath)
+
+	oldEntry, err := d.lookup("rename", oldPath)
+	if err != nil {
+		return err
+	} else if oldPath == newPath {
+		return nil
+	} else if isPathInside(newPath, oldPath) {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: fs.ErrInvalid}
+	} else if err := d.checkParentDir("rename", newPath); err != nil {
+		return err
+	}
+
+	if newEntry, ok := d.entries[newPath]; ok {
+		switch {
+		case newEntry.Mode.IsDir() && !oldEntry.Mode.IsDir():
+			return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: syscall.EISDIR}
+		case !newEntry.Mode.IsDir() && oldEntry.Mode.IsDir():
+			return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: syscall.ENOTDIR}
+		case len(d.pathsBelow(newPath)) > 1:
+			return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: syscall.ENOTEMPTY}
+		}
+
+		delete(d.entries, newPath)
+	}
+
+	for _, entryPath := range d.pathsBelow(oldPath) {
+		d.entries[newPath+strings.TrimPrefix(entryPath, oldPath)] = d.entries[entryPath]
+		delete(d.entries, entryPath)
+	}
+
+	return nil
+}
+
+func (d *MemDest) Link(target, path string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entry, err := d.lookup("link", target)
+	if err != nil {
+		return err
+	} else if entry.Mode.IsDir() {
+		return &os.LinkError{Op: "link", Old: target, New: path, Err: syscall.EPERM}
+	}
+
+	if err := d.checkParentDir("link", path); err != nil {
+		return err
+	} else if _, ok := d.entries[filepath.Clean(path)]; ok {
+		return &os.LinkError{Op: "link", Old: target, New: path, Err: fs.ErrExist}
+	}
+
+	d.entries[filepath.Clean(path)] = entry
+
+	return nil
+}
+
+func (d *MemDest) Mknod(path string, mode fs.FileMode, dev uint64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.create("mknod", path, &MemEntry{Mode: mode, Dev: dev})
+}
+
+func (d *MemDest) Lchtimes(path string, atime, mtime time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entry, err := d.lookup("lchtimes", path)
+	if err != nil {
+		return err
+	}
+
+	entry.Atime, entry.ModTime = atime, mtime
+
+	return nil
+}
+
+func (d *MemDest) Lsetxattr(path, name string, value []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entry, err := d.lookup("lsetxattr", path)
+	if err != nil {
+		return err
+	}
+
+	if entry.Xattrs == nil {
+		entry.Xattrs = map[string][]byte{}
+	}
+	entry.Xattrs[name] = append([]byte(nil), value...)
+
+	return nil
+}
+
+func (d *MemDest) lookup(op, path string) (*MemEntry, error) {
+	entry, ok := d.entries[filepath.Clean(path)]
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: path, Err: fs.ErrNotExist}
+	}
+
+	return entry, nil
+}
+
+func (d *MemDest) checkParentDir(op, path string) error {
+	parentEntry, ok := d.entries[getParentDir(path)]
+	if !ok {
+		return &fs.PathError{Op: op, Path: path, Err: fs.ErrNotExist}
+	} else if !parentEntry.Mode.IsDir() {
+		return &fs.PathError{Op: op, Path: path, Err: syscall.ENOTDIR}
+	}
+
+	return nil
+}
+
+// New entries owned by the current user, as in the local file system.
+func (d *MemDest) create(op, path string, entry *MemEntry) error {
+	if err := d.checkParentDir(op, path); err != nil {
+		return err
+	} else if _, ok := d.entries[filepath.Clean(path)]; ok {
+		return &fs.PathError{Op: op, Path: path, Err: fs.ErrExist}
+	}
+
+	entry.UID, entry.GID = os.Geteuid(), os.Getegid()
+	entry.Atime = time.Now()
+	entry.ModTime = entry.Atime
+	d.entries[filepath.Clean(path)] = entry
+
+	return nil
+}
+
+// Path itself, if exists, and all paths below it.
+func (d *MemDest) pathsBelow(path string) []string {
+	var paths []string
+	for entryPath := range d.entries {
+		if isPathInside(entryPath, filepath.Clean(path)) {
+			paths = append(paths, entryPath)
+		}
+	}
+
+	return paths
+}
+
+func (e *MemEntry) copy() MemEntry {
+	entryCopy := *e
+	entryCopy.Data = append([]byte(nil), e.Data...)
+
+	if e.Xattrs != nil {
+		entryCopy.Xattrs = make(map[string][]byte, len(e.Xattrs))
+		for name, value := range e.Xattrs {
+			entryCopy.Xattrs[name] = append([]byte(nil), value...)
+		}
+	}
+
+	return entryCopy
+}
+
+type memFile struct {
+	dest   *MemDest
+	entry  *MemEntry
+	offset int64
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.dest.mu.Lock()
+	defer f.dest.mu.Unlock()
+
+	if off >= int64(len(f.entry.Data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.entry.Data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.dest.mu.Lock()
+	defer f.dest.mu.Unlock()
+
+	if end := f.offset + int64(len(p)); end > int64(len(f.entry.Data)) {
+		f.entry.Data = append(f.entry.Data, make([]byte, end-int64(len(f.entry.Data)))...)
+	}
+
+	n := copy(f.entry.Data[f.offset:], p)
+	f.offset += int64(n)
+	f.entry.ModTime = time.Now()
+
+	return n, nil
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+type memFileInfo struct {
+	name  string
+	entry MemEntry
+	// Entry in MemDest, so that hard links can be detected.
+	origin *MemEntry
+}
+
+func (i *memFileInfo) Name() string {
+	return i.name
+}
+
+func (i *memFileInfo) Size() int64 {
+	if i.entry.Mode&fs.ModeSymlink != 0 {
+		return int64(len(i.entry.Target))
+	}
+
+	return int64(len(i.entry.Data))
+}
+
+func (i *memFileInfo) Mode() fs.FileMode {
+	return i.entry.Mode
+}
+
+func (i *memFileInfo) ModTime() time.Time {
+	return i.entry.ModTime
+}
+
+func (i *memFileInfo) IsDir() bool {
+	return i.entry.Mode.IsDir()
+}
+
+// Returns *MemEntry.
+func (i *memFileInfo) Sys() any {
+	return &i.entry
+}
@@ -0,0 +1,124 @@
+package copyrec_test
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing/fstest"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	copyrec "github.com/werf/copy-recurse"
+)
+
+var _ = Describe("MemDest", func() {
+	ctx := context.Background()
+
+	It("should copy directory from disk into memory", func() {
+		tmpSrc, err := os.MkdirTemp("", "*-copyrec-test")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tmpSrc)
+
+		Expect(os.Mkdir(filepath.Join(tmpSrc, "dir"), 0o750)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(tmpSrc, "dir", "file"), []byte("content"), 0o640)).To(Succeed())
+		Expect(os.Link(filepath.Join(tmpSrc, "dir", "file"), filepath.Join(tmpSrc, "hardlink"))).To(Succeed())
+		Expect(os.Symlink("dir/file", filepath.Join(tmpSrc, "symlink"))).To(Succeed())
+		modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		Expect(os.Chtimes(filepath.Join(tmpSrc, "dir", "file"), modTime, modTime)).To(Succeed())
+
+		memDest := copyrec.NewMemDest()
+		copyRec, err := copyrec.New(tmpSrc, "/dest", copyrec.Options{
+			Dest:              memDest,
+			PreserveHardLinks: true,
+			PreserveTimes:     true,
+			VerifyContent:     true,
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		result, err := copyRec.RunWithResult(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.Files).To(Equal(int64(2)))
+		Expect(memDest.Paths()).To(Equal([]string{"/", "/dest", "/dest/dir", "/dest/dir/file", "/dest/hardlink", "/dest/symlink"}))
+
+		entry, ok := memDest.Entry("/dest/dir")
+		Expect(ok).To(BeTrue())
+		Expect(entry.Mode).To(Equal(fs.ModeDir | 0o750))
+
+		entry, ok = memDest.Entry("/dest/dir/file")
+		Expect(ok).To(BeTrue())
+		Expect(entry.Mode).To(Equal(fs.FileMode(0o640)))
+		Expect(string(entry.Data)).To(Equal("content"))
+		Expect(entry.ModTime.Equal(modTime)).To(BeTrue())
+		Expect(entry.UID).To(Equal(os.Geteuid()))
+
+		entry, ok = memDest.Entry("/dest/symlink")
+		Expect(ok).To(BeTrue())
+		Expect(entry.Mode.Type()).To(Equal(fs.ModeSymlink))
+		Expect(entry.Target).To(Equal("dir/file"))
+
+		// Hard links share the same entry.
+		Expect(memDest.OpenFile("/dest/hardlink", os.O_WRONLY|os.O_TRUNC, 0)).ToNot(BeNil())
+		entry, _ = memDest.Entry("/dest/dir/file")
+		Expect(entry.Data).To(BeEmpty())
+	})
+
+	It("should test matchers without touching disk", func() {
+		fsys := fstest.MapFS{
+			"src/main.go":         {Data: []byte("package main")},
+			"src/debug.log":       {Data: []byte("log")},
+			"src/build/out":       {Data: []byte("out")},
+			"src/vendor/mod/a.go": {Data: []byte("package mod")},
+		}
+
+		matchers, err := copyrec.NewGitignoreMatchers("src", strings.NewReader("*.log\nbuild/\n"))
+		Expect(err).ToNot(HaveOccurred())
+
+		memDest := copyrec.NewMemDest()
+		copyRec, err := copyrec.NewFS(fsys, "src", "/dest", copyrec.Options{
+			Dest:      memDest,
+			MatchDir:  matchers.MatchDir,
+			MatchFile: matchers.MatchFile,
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(copyRec.Run(ctx)).To(Succeed())
+		Expect(memDest.Paths()).To(Equal([]string{"/", "/dest", "/dest/main.go", "/dest/vendor", "/dest/vendor/mod", "/dest/vendor/mod/a.go"}))
+	})
+
+	It("should replace and mirror existing destination atomically", func() {
+		fsys := fstest.MapFS{
+			"src/dir/file": {Data: []byte("new")},
+		}
+
+		memDest := copyrec.NewMemDest()
+		Expect(memDest.Mkdir("/dest", 0o755)).To(Succeed())
+		Expect(memDest.Mkdir("/dest/dir", 0o755)).To(Succeed())
+		Expect(memDest.Symlink("/elsewhere", "/dest/dir/file")).To(Succeed())
+		file, err := memDest.OpenFile("/dest/stale", os.O_WRONLY|os.O_CREATE, 0o644)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(file.Write([]byte("stale"))).To(Equal(5))
+
+		copyRec, err := copyrec.NewFS(fsys, "src", "/dest", copyrec.Options{
+			Dest:          memDest,
+			AtomicReplace: true,
+			Mirror:        true,
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(copyRec.Run(ctx)).To(Succeed())
+		Expect(memDest.Paths()).To(Equal([]string{"/", "/dest", "/dest/dir", "/dest/dir/file"}))
+
+		entry, _ := memDest.Entry("/dest/dir/file")
+		Expect(entry.Mode.IsRegular()).To(BeTrue())
+		Expect(string(entry.Data)).To(Equal("new"))
+	})
+
+	It("should not allow safe access to custom destination", func() {
+		_, err := copyrec.New("/src", "/dest", copyrec.Options{Dest: copyrec.NewMemDest(), SafeDest: true})
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,10 @@
+//go:build !freebsd && !windows
+// +build !freebsd,!windows
+
+package copyrec
+
+import "golang.org/x/sys/unix"
+
+func mknod(path string, mode uint32, dev uint64) error {
+	return unix.Mknod(path, mode, int(dev))
+}
@@ -0,0 +1,20 @@
+//go:build !freebsd && !windows
+// +build !freebsd,!windows
+
+package copyrec_test
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"golang.org/x/sys/unix"
+)
+
+func mknodOrSkip(path string, mode uint32, dev uint64) {
+	err := unix.Mknod(path, mode, int(dev))
+	if errors.Is(err, unix.EPERM) {
+		Skip("creating devices not permitted")
+	}
+	Expect(err).ToNot(HaveOccurred())
+}
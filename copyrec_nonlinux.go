@@ -0,0 +1,79 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package copyrec
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Copies length bytes from the current offset of srcFile to the current offset of destFile.
+func copyFileDataWithMethod(method CopyMethod, srcFile, destFile *os.File, length int64) error {
+	if method == CopyMethodUserspace {
+		return copyFileDataInUserspace(io.LimitReader(srcFile, length), destFile)
+	}
+
+	return fmt.Errorf("%w: %s is supported only on Linux", errCopyMethodNotSupported, method)
+}
+
+// Futimens is not wrapped by x/sys/unix on this platform, so setting times by path the file opened with.
+func futimens(file *os.File, atime, mtime time.Time) error {
+	times := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, file.Name(), times, 0)
+}
+
+// Sparse files are not detected on this platform, copying the whole file.
+func copySparseFileDataWithMethod(method CopyMethod, srcFile, destFile *os.File, size int64) error {
+	return copyFileDataWithMethod(method, srcFile, destFile, size)
+}
+
+var (
+	errXattrsNotSupported = errors.New("extended attributes are supported only on Linux")
+	errXattrNotFound      = errors.New("extended attribute not found")
+)
+
+func listXattrs(path string) ([]string, error) {
+	return nil, errXattrsNotSupported
+}
+
+func getXattr(path, name string) ([]byte, error) {
+	return nil, errXattrsNotSupported
+}
+
+func setXattr(path, name string, value []byte) error {
+	return errXattrsNotSupported
+}
+
+func isXattrNotSupportedErr(err error) bool {
+	return errors.Is(err, errXattrsNotSupported)
+}
+
+// Page cache can't be dropped for a file, so only writing file data to storage.
+func dropFileCache(file *os.File) error {
+	return file.Sync()
+}
+
+func exchangePaths(path1, path2 string) error {
+	return fmt.Errorf("%w: supported only on Linux", errExchangeNotSupported)
+}
+
+var errDestRootNotSupported = errors.New("safe destination access is supported only on Linux")
+
+// Never opened, but has to implement Dest to be used in place of the local file system.
+type destRoot struct {
+	Dest
+}
+
+func openDestRoot(path string) (*destRoot, error) {
+	return nil, errDestRootNotSupported
+}
+
+func (r *destRoot) close() error {
+	return errDestRootNotSupported
+}
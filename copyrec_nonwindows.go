@@ -4,25 +4,136 @@
 package copyrec
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/fs"
+	"math"
+	"math/rand"
 	"os"
+	"path"
 	"path/filepath"
-	"sort"
 	"strings"
 	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/sys/unix"
 
 	"github.com/werf/logboek"
 )
 
+const (
+	specialModeBits = os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+	ownerRWXBits    = os.FileMode(0o700)
+
+	specialFileModeTypes = os.ModeNamedPipe | os.ModeDevice | os.ModeCharDevice | os.ModeSocket
+
+	// The same limit as in the Linux kernel.
+	maxResolvedSymlinks = 40
+)
+
+var (
+	errCopyMethodNotSupported = errors.New("copy method not supported")
+	errExchangeNotSupported   = errors.New("atomic exchange not supported")
+)
+
+// Like New, but copies root directory or file of fsys, e.g. embed.FS, zip.Reader or fstest.MapFS. Symlinks read with
+// Lstat and ReadLink methods of fsys if it has them, otherwise symlinks recognized only if fsys reports them in file
+// mode without following, and their destinations read as file contents. Files without syscall.Stat_t copied with
+// ownership of the current user.
+func NewFS(fsys fs.FS, root, dest string, opts Options) (*CopyRecurse, error) {
+	if !fs.ValidPath(root) {
+		return nil, fmt.Errorf("invalid root path %q", root)
+	}
+
+	if opts.Symlinks == SymlinkFollow {
+		return nil, fmt.Errorf("following symlinks not supported for fs.FS source")
+	}
+
+	copyRec, err := New(root, dest, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	copyRec.src = root
+	copyRec.srcFS = fsys
+
+	return copyRec, nil
+}
+
 func New(src, dest string, opts Options) (*CopyRecurse, error) {
 	copyRec := &CopyRecurse{
 		uid:                           opts.UID,
 		gid:                           opts.GID,
 		abortIfDestParentDirNotExists: opts.AbortIfDestParentDirNotExists,
+		copyMethods:                   opts.CopyMethods,
+		onFileDataCopied:              opts.OnFileDataCopied,
+		preserveHardLinks:             opts.PreserveHardLinks,
+		preserveSparseFiles:           opts.PreserveSparseFiles,
+		preserveTimes:                 opts.PreserveTimes,
+		copyXattrs:                    opts.CopyXattrs,
+		xattrIncludes:                 opts.XattrIncludes,
+		xattrExcludes:                 opts.XattrExcludes,
+		onXattrError:                  opts.OnXattrError,
+		fifoAction:                    opts.FIFOAction,
+		charDeviceAction:              opts.CharDeviceAction,
+		blockDeviceAction:             opts.BlockDeviceAction,
+		onSocket:                      opts.OnSocket,
+		symlinks:                      opts.Symlinks,
+		maxSymlinkDepth:               opts.MaxSymlinkDepth,
+		escapingSymlinks:              opts.EscapingSymlinks,
+		onEscapingSymlink:             opts.OnEscapingSymlink,
+		concurrency:                   opts.Concurrency,
+		atomicReplace:                 opts.AtomicReplace,
+		stageAndSwap:                  opts.StageAndSwap,
+		compareMethod:                 opts.CompareMethod,
+		verifyContent:                 opts.VerifyContent,
+		verifyHash:                    opts.VerifyHash,
+		mirror:                        opts.Mirror,
+		mirrorProtect:                 opts.MirrorProtect,
+		onProgress:                    opts.Progress,
+		progressInterval:              opts.ProgressInterval,
+		safeDest:                      opts.SafeDest,
+		destFS:                        opts.Dest,
+	}
+
+	if copyRec.destFS == nil {
+		copyRec.destFS = osDest{}
+	} else if copyRec.safeDest {
+		return nil, fmt.Errorf("safe destination access not supported with custom destination")
+	}
+
+	if copyRec.copyMethods == nil {
+		copyRec.copyMethods = DefaultCopyMethods
+	} else if len(copyRec.copyMethods) == 0 {
+		return nil, fmt.Errorf("at least one copy method should be allowed")
+	}
+
+	if copyRec.verifyHash == nil {
+		copyRec.verifyHash = sha256.New
+	}
+
+	if copyRec.progressInterval == 0 {
+		copyRec.progressInterval = DefaultProgressInterval
+	}
+
+	if copyRec.maxSymlinkDepth == 0 {
+		copyRec.maxSymlinkDepth = DefaultMaxSymlinkDepth
+	}
+
+	if copyRec.symlinks == SymlinkFollow && copyRec.escapingSymlinks == EscapingSymlinkRewrite {
+		return nil, fmt.Errorf("rewriting of escaping symlinks not supported while following symlinks")
+	}
+
+	for _, pattern := range append(append([]string{}, opts.XattrIncludes...), opts.XattrExcludes...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid extended attribute pattern %q: %w", pattern, err)
+		}
 	}
 
 	var err error
@@ -36,9 +147,18 @@ func New(src, dest string, opts Options) (*CopyRecurse, error) {
 		return nil, fmt.Errorf("error getting absolute path for dest %q: %w", dest, err)
 	}
 
-	copyRec.dest, err = dereferenceDestIfDir(copyRec.dest)
-	if err != nil {
-		return nil, fmt.Errorf("error dereferencing dest if directory: %w", err)
+	if opts.Dest == nil {
+		copyRec.dest, err = dereferenceDestIfDir(copyRec.dest)
+		if err != nil {
+			return nil, fmt.Errorf("error dereferencing dest if directory: %w", err)
+		}
+	}
+
+	if opts.OldDestPath != "" {
+		copyRec.oldDestPath, err = filepath.Abs(opts.OldDestPath)
+		if err != nil {
+			return nil, fmt.Errorf("error getting absolute path for old dest %q: %w", opts.OldDestPath, err)
+		}
 	}
 
 	switch {
@@ -68,51 +188,267 @@ func New(src, dest string, opts Options) (*CopyRecurse, error) {
 }
 
 func (c *CopyRecurse) Run(ctx context.Context) error {
+	return c.run(ctx)
+}
+
+// RunWithResult is the same as Run, but also returns statistics of copying, even if copying failed halfway.
+func (c *CopyRecurse) RunWithResult(ctx context.Context) (Result, error) {
+	startTime := time.Now()
+	err := c.run(ctx)
+	c.result.Elapsed = time.Since(startTime)
+
+	return c.result, err
+}
+
+// Plan walks source with the same matching as Run and returns actions Run would do in the same order, without
+// changing anything. Extended attributes and times are not included. Not supported with StageAndSwap.
+func (c *CopyRecurse) Plan(ctx context.Context) ([]PlanAction, error) {
+	// Copying to a staging directory would be planned as creating everything anew, and the previous destination
+	// removed or moved aside as a whole, which says nothing about changes of destination entries.
+	if c.stageAndSwap {
+		return nil, fmt.Errorf("planning is not supported for copying through a staging directory")
+	}
+
+	c.planning = true
+	c.planActions = []PlanAction{}
+	c.plannedDirs = map[string]struct{}{}
+	defer func() {
+		c.planning = false
+		c.planActions = nil
+		c.plannedDirs = nil
+	}()
+
+	if err := c.run(ctx); err != nil {
+		return nil, err
+	}
+
+	return c.planActions, nil
+}
+
+func (c *CopyRecurse) run(ctx context.Context) error {
+	c.visitedDestDirs = map[string]struct{}{}
+	c.result = Result{}
+	if c.preserveHardLinks {
+		c.hardLinks = map[hardLinkKey]*hardLink{}
+	}
+	c.pendingDestDirs = nil
+
 	if err := c.prepareDestParentDir(ctx); err != nil {
 		return fmt.Errorf("error creating destination directory: %w", err)
 	}
 
-	if err := walkPath(ctx, c.src, func(relEntryPath string, dirEntry *fs.DirEntry, err error) error {
+	// Planning doesn't change destination, while destination parent directory might not exist yet.
+	if c.safeDest && !c.planning {
+		destRoot, err := openDestRoot(getParentDir(c.dest))
 		if err != nil {
-			return fmt.Errorf("error walking path: %w", err)
+			return fmt.Errorf("error opening destination parent directory: %w", err)
 		}
 
-		entrySrc := filepath.Join(c.src, relEntryPath)
-		entryDest := filepath.Join(c.dest, relEntryPath)
+		c.destFS = destRoot
+		defer func() {
+			destRoot.close()
+			c.destFS = osDest{}
+		}()
+	}
 
-		logboek.Context(ctx).Debug().LogF("Walking path %q.\n", entrySrc)
+	if c.stageAndSwap {
+		return c.copyStagedAndSwap(ctx)
+	}
 
-		if (*dirEntry).IsDir() {
-			if err := c.processDir(ctx, entrySrc, entryDest); errors.Is(err, fs.SkipDir) {
-				return fs.SkipDir
-			} else if err != nil {
-				return fmt.Errorf("error processing directory: %w", err)
-			}
-		} else {
-			if err := c.processFile(ctx, entrySrc, entryDest); err != nil {
-				return fmt.Errorf("error processing file: %w", err)
+	return c.copy(ctx)
+}
+
+func (c *CopyRecurse) copy(ctx context.Context) error {
+	// Unlike context of workers, cancelled only by caller.
+	callerCtx := ctx
+
+	if c.onProgress != nil && !c.planning {
+		c.progress = newProgressReporter(c.onProgress, c.progressInterval)
+		defer func() { c.progress = nil }()
+	}
+
+	// Planning is always sequential to keep actions in order.
+	if c.concurrency > 1 && !c.planning {
+		// Logboek falls back to the default logger only for context.Background(), not for contexts derived from it.
+		ctx = logboek.NewContext(ctx, logboek.Context(ctx))
+
+		c.workers = newWorkerPool(ctx, c.concurrency)
+		defer func() { c.workers = nil }()
+
+		// Failed file copying in one of workers stops walking too.
+		ctx = c.workers.ctx
+	}
+
+	walkErr := c.walkMatches(ctx, c.src, c.dest, false, nil)
+
+	var copyErr error
+	if c.workers != nil {
+		if walkErr != nil {
+			c.workers.cancel()
+		}
+
+		// Error of a worker is the reason of walking cancellation, if any. Jobs skipped because of walking error are
+		// reported with the context error.
+		if err := c.workers.wait(); err != nil && (walkErr == nil || !errors.Is(err, context.Canceled)) {
+			copyErr = fmt.Errorf("error copying file: %w", err)
+		}
+	}
+
+	if copyErr == nil && walkErr != nil {
+		copyErr = fmt.Errorf("error walking path: %w", walkErr)
+	}
+
+	// Walking might be done before cancellation, while not all of the entries copied.
+	if copyErr == nil && callerCtx.Err() != nil {
+		copyErr = fmt.Errorf("copying cancelled: %w", callerCtx.Err())
+	}
+
+	if copyErr != nil {
+		// Otherwise already created directories left writable. Staging directory is removed on failure, so it is
+		// left writable to be removed.
+		if !c.stageAndSwap && !c.planning {
+			if err := c.processPendingDestDirs(ctx); err != nil {
+				logboek.Context(ctx).Warn().LogF("Unable to set modes and times of destination directories: %s.\n", err)
 			}
 		}
 
+		return copyErr
+	}
+
+	if err := c.processPendingDestDirs(ctx); err != nil {
+		return fmt.Errorf("error processing pending destination directories: %w", err)
+	}
+
+	c.progress.report()
+
+	return nil
+}
+
+// Copies to a staging directory next to destination and swaps them, leaving destination untouched on failure.
+func (c *CopyRecurse) copyStagedAndSwap(ctx context.Context) error {
+	if srcFileInfo, err := c.statSrc(c.src); err != nil {
+		return fmt.Errorf("error getting file info for %q: %w", c.src, err)
+	} else if !srcFileInfo.IsDir() {
+		return fmt.Errorf("source %q should be a directory to copy through a staging directory", c.src)
+	}
+
+	dest := c.dest
+	stagingPath, err := createTempDestEntry(dest, func(tmpPath string) error {
+		return c.mkdir(tmpPath, ownerRWXBits)
+	})
+	if err != nil {
+		return fmt.Errorf("error creating staging directory for %q: %w", dest, err)
+	}
+
+	logboek.Context(ctx).Debug().LogF("Copying to staging dir %q.\n", stagingPath)
+	c.dest = stagingPath
+	copyErr := func() error {
+		// Staging dir gets mode and ownership of source even if nothing matched.
+		if err := c.createEmptyDirsChain(ctx, stagingPath); err != nil {
+			return fmt.Errorf("error creating staging directory: %w", err)
+		}
+
+		return c.copy(ctx)
+	}()
+	c.dest = dest
+
+	var oldDestPath string
+	if copyErr == nil {
+		oldDestPath, copyErr = c.swapStagingDir(ctx, stagingPath, dest)
+	}
+
+	if copyErr != nil {
+		logboek.Context(ctx).Debug().LogF("Removing staging dir %q.\n", stagingPath)
+		if err := c.removeDestAll(stagingPath); err != nil {
+			logboek.Context(ctx).Warn().LogF("Unable to remove staging dir %q: %s.\n", stagingPath, err)
+		}
+
+		return copyErr
+	}
+
+	if oldDestPath == "" {
 		return nil
-	}); err != nil {
-		return fmt.Errorf("error walking path: %w", err)
+	}
+
+	// New destination is already in place, so failing to clean up after it is not a failure of copying.
+	if c.oldDestPath != "" {
+		logboek.Context(ctx).Debug().LogF("Renaming previous destination %q to %q.\n", oldDestPath, c.oldDestPath)
+		// Path for previous destination might be outside of destination root.
+		renameOldDest := c.renameDest
+		if _, ok := c.destFS.(*destRoot); ok {
+			renameOldDest = os.Rename
+		}
+
+		if err := renameOldDest(oldDestPath, c.oldDestPath); err != nil {
+			logboek.Context(ctx).Warn().LogF("Unable to rename previous destination %q to %q: %s.\n", oldDestPath, c.oldDestPath, err)
+		}
+	} else {
+		logboek.Context(ctx).Debug().LogF("Removing previous destination %q.\n", oldDestPath)
+		if err := c.removeDestAll(oldDestPath); err != nil {
+			logboek.Context(ctx).Warn().LogF("Unable to remove previous destination %q: %s.\n", oldDestPath, err)
+		}
 	}
 
 	return nil
 }
 
+// Puts staging dir in place of destination and returns the path the previous destination ended up at, if any.
+// Destination and staging dir left untouched if swapping failed.
+func (c *CopyRecurse) swapStagingDir(ctx context.Context, stagingPath, dest string) (string, error) {
+	if _, err := c.lstatDest(dest); errors.Is(err, os.ErrNotExist) {
+		logboek.Context(ctx).Debug().LogF("Renaming staging dir %q to %q.\n", stagingPath, dest)
+		if err := c.renameDest(stagingPath, dest); err != nil {
+			return "", fmt.Errorf("error renaming staging dir %q to %q: %w", stagingPath, dest, err)
+		}
+
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("error getting file info for %q: %w", dest, err)
+	}
+
+	// Previous destination ends up at staging path after exchange.
+	oldDestPath := stagingPath
+
+	logboek.Context(ctx).Debug().LogF("Exchanging staging dir %q with %q.\n", stagingPath, dest)
+	if err := c.exchangeDest(stagingPath, dest); errors.Is(err, errExchangeNotSupported) {
+		logboek.Context(ctx).Debug().LogF("Atomic exchange not supported, renaming %q aside: %s.\n", dest, err)
+
+		oldDestPath, err = createTempDestEntry(dest, func(tmpPath string) error {
+			// Rename silently replaces an empty directory, so making sure nothing is there.
+			if _, err := c.lstatDest(tmpPath); err == nil {
+				return os.ErrExist
+			}
+			return c.renameDest(dest, tmpPath)
+		})
+		if err != nil {
+			return "", fmt.Errorf("error renaming %q aside: %w", dest, err)
+		}
+
+		logboek.Context(ctx).Debug().LogF("Renaming staging dir %q to %q.\n", stagingPath, dest)
+		if err := c.renameDest(stagingPath, dest); err != nil {
+			if err := c.renameDest(oldDestPath, dest); err != nil {
+				logboek.Context(ctx).Warn().LogF("Unable to rename %q back to %q: %s.\n", oldDestPath, dest, err)
+			}
+			return "", fmt.Errorf("error renaming staging dir %q to %q: %w", stagingPath, dest, err)
+		}
+	} else if err != nil {
+		return "", fmt.Errorf("error exchanging staging dir %q with %q: %w", stagingPath, dest, err)
+	}
+
+	return oldDestPath, nil
+}
+
 func (c *CopyRecurse) prepareDestParentDir(ctx context.Context) error {
 	logboek.Context(ctx).Debug().LogF("Preparing parent dir for destination %q.\n", c.dest)
 
 	destParentDir := getParentDir(c.dest)
-	if fileInfo, err := os.Lstat(destParentDir); errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+	if fileInfo, err := c.lstatDest(destParentDir); errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
 		if c.abortIfDestParentDirNotExists {
 			return fmt.Errorf("directory %q does not exist", destParentDir)
 		}
 
 		logboek.Context(ctx).Debug().LogF("Creating destination parent dir (and its parents) at %q.\n", destParentDir)
-		if err := os.MkdirAll(destParentDir, os.ModePerm); err != nil {
+		if err := c.mkdirAll(destParentDir, os.ModePerm); err != nil {
 			return fmt.Errorf("error creating directories up to parent destination directory %q: %w", destParentDir, err)
 		}
 	} else if err != nil {
@@ -122,7 +458,7 @@ func (c *CopyRecurse) prepareDestParentDir(ctx context.Context) error {
 			return fmt.Errorf("error recreating parent dir: %w", err)
 		}
 	} else if fileInfo.Mode()&os.ModeSymlink != 0 {
-		if dereferencedDestParentDir, err := os.Stat(destParentDir); errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+		if dereferencedDestParentDir, err := c.statDest(destParentDir); errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
 			if err := c.recreateParentDir(ctx, destParentDir); err != nil {
 				return fmt.Errorf("error recreating parent dir: %w", err)
 			}
@@ -144,25 +480,135 @@ func (c *CopyRecurse) recreateParentDir(ctx context.Context, destParentDir strin
 	}
 
 	logboek.Context(ctx).Debug().LogF("Removing file in place of a destination parent dir %q.\n", destParentDir)
-	if err := os.RemoveAll(destParentDir); err != nil {
+	if err := c.removeAll(destParentDir); err != nil {
 		return fmt.Errorf("error removing file in place of a destination parent dir %q: %w", destParentDir, err)
 	}
 
 	logboek.Context(ctx).Debug().LogF("Creating destination parent dir (and its parents) at %q.\n", destParentDir)
-	if err := os.MkdirAll(destParentDir, os.ModePerm); err != nil {
+	if err := c.mkdirAll(destParentDir, os.ModePerm); err != nil {
 		return fmt.Errorf("error creating directories up to parent destination directory %q: %w", destParentDir, err)
 	}
 
 	return nil
 }
 
-func (c *CopyRecurse) processFile(ctx context.Context, src, dest string) error {
+// Walks src looking for matching directories and files to copy. If follow is true, then src is a followed symlink to
+// a directory already matched, and real paths of directories with symlinks followed to get to it are in followedFrom.
+func (c *CopyRecurse) walkMatches(ctx context.Context, src, dest string, follow bool, followedFrom []string) error {
+	return c.walkPath(ctx, src, follow, func(relEntryPath string, dirEntry *fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("error walking path: %w", err)
+		}
+
+		// Followed symlink itself already walked and matched as an entry of its parent directory.
+		if follow && relEntryPath == "." {
+			return nil
+		}
+
+		entrySrc := filepath.Join(src, relEntryPath)
+		entryDest := filepath.Join(dest, relEntryPath)
+
+		logboek.Context(ctx).Debug().LogF("Walking path %q.\n", entrySrc)
+		c.progress.update(entrySrc, func(progress *Progress) { progress.EntriesWalked++ })
+
+		switch {
+		case (*dirEntry).IsDir():
+			if err := c.processDir(ctx, entrySrc, entryDest, followedFrom); errors.Is(err, fs.SkipDir) {
+				return fs.SkipDir
+			} else if err != nil {
+				return fmt.Errorf("error processing directory: %w", err)
+			}
+
+			// Directory not matched fully, but walked to look for matches.
+			if c.mirror {
+				if err := c.mirrorDir(ctx, entrySrc, entryDest, false); err != nil {
+					return fmt.Errorf("error mirroring directory: %w", err)
+				}
+			}
+		case (*dirEntry).Type()&fs.ModeSymlink != 0 && c.symlinks == SymlinkFollow:
+			if err := c.processFollowedSymlink(ctx, entrySrc, entryDest, followedFrom); err != nil {
+				return fmt.Errorf("error processing symlink: %w", err)
+			}
+		default:
+			if err := c.processFile(ctx, entrySrc, entryDest, followedFrom); err != nil {
+				return fmt.Errorf("error processing file: %w", err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// Symlinks to directories are matched and walked as directories with paths below the symlink, other symlinks are
+// matched as files.
+func (c *CopyRecurse) processFollowedSymlink(ctx context.Context, src, dest string, followedFrom []string) error {
+	logboek.Context(ctx).Debug().LogF("Processing followed symlink %q.\n", src)
+
+	// Dangling symlinks fail or are skipped while copying.
+	if targetFileInfo, err := c.statSrc(src); err != nil || !targetFileInfo.IsDir() {
+		return c.processFile(ctx, src, dest, followedFrom)
+	}
+
+	action, err := c.matchDir(src)
+	if err != nil {
+		return fmt.Errorf("error matching directory %q: %w", src, err)
+	}
+
+	switch action {
+	case DirMatch:
+		logboek.Context(ctx).Debug().LogF("Dir %q fully matched.\n", src)
+		c.progress.update(src, func(progress *Progress) { progress.EntriesMatched++ })
+
+		if err := c.copyRecurse(ctx, src, dest, followedFrom); err != nil {
+			return fmt.Errorf("error copying directory: %w", err)
+		}
+		return nil
+	case DirFallThrough:
+		logboek.Context(ctx).Debug().LogF("Will look for matches in directory %q.\n", src)
+
+		linkDestination, err := c.readSrcLink(src)
+		if err != nil {
+			return fmt.Errorf("error reading symlink %q: %w", src, err)
+		}
+
+		if _, keep, err := c.processEscapingSymlink(ctx, src, linkDestination); err != nil {
+			return fmt.Errorf("error processing symlink: %w", err)
+		} else if !keep {
+			return nil
+		}
+
+		_, followedFrom, err = c.followSymlink(ctx, src, followedFrom)
+		if err != nil {
+			return fmt.Errorf("error following symlink: %w", err)
+		}
+
+		if c.mirror {
+			if err := c.mirrorDir(ctx, src, dest, false); err != nil {
+				return fmt.Errorf("error mirroring directory: %w", err)
+			}
+		}
+
+		if err := c.walkMatches(ctx, src, dest, true, followedFrom); err != nil {
+			return fmt.Errorf("error walking symlink target: %w", err)
+		}
+		return nil
+	case DirSkip:
+		logboek.Context(ctx).Debug().LogF("Skipping directory %q.\n", src)
+		return nil
+	default:
+		panic(fmt.Sprintf("unexpected action (int %d)", action))
+	}
+}
+
+func (c *CopyRecurse) processFile(ctx context.Context, src, dest string, followedFrom []string) error {
 	logboek.Context(ctx).Debug().LogF("Processing file %q.\n", src)
 
 	if match, err := c.matchFile(src); err != nil {
 		return fmt.Errorf("error matching file %q: %w", src, err)
 	} else if match {
-		if err := c.copyRecurse(ctx, src, dest); err != nil {
+		c.progress.update(src, func(progress *Progress) { progress.EntriesMatched++ })
+
+		if err := c.copyRecurse(ctx, src, dest, followedFrom); err != nil {
 			return fmt.Errorf("error copying file: %w", err)
 		}
 		return nil
@@ -172,7 +618,7 @@ func (c *CopyRecurse) processFile(ctx context.Context, src, dest string) error {
 	}
 }
 
-func (c *CopyRecurse) processDir(ctx context.Context, src, dest string) error {
+func (c *CopyRecurse) processDir(ctx context.Context, src, dest string, followedFrom []string) error {
 	logboek.Context(ctx).Debug().LogF("Processing directory %q.\n", src)
 
 	if filepath.Clean(src) == c.src {
@@ -188,10 +634,11 @@ func (c *CopyRecurse) processDir(ctx context.Context, src, dest string) error {
 	switch action {
 	case DirMatch:
 		logboek.Context(ctx).Debug().LogF("Dir %q fully matched.\n", src)
-		if err := c.copyRecurse(ctx, src, dest); err != nil {
+		if err := c.copyRecurse(ctx, src, dest, followedFrom); err != nil {
 			return fmt.Errorf("error copying directory: %w", err)
 		}
-		return nil
+		// Directory already copied with all of its entries, no need to walk it.
+		return fs.SkipDir
 	case DirFallThrough:
 		logboek.Context(ctx).Debug().LogF("Will look for matches in directory %q.\n", src)
 		return nil
@@ -203,17 +650,37 @@ func (c *CopyRecurse) processDir(ctx context.Context, src, dest string) error {
 	}
 }
 
-func (c *CopyRecurse) copyRecurse(ctx context.Context, src, dest string) error {
+// Real paths of directories with symlinks followed to get to src are in followedFrom.
+func (c *CopyRecurse) copyRecurse(ctx context.Context, src, dest string, followedFrom []string) error {
 	logboek.Context(ctx).Debug().LogF("Going to recursively copy %q to %q with UID/GID %v/%v.\n", src, dest, uint32PtrPString(c.uid), uint32PtrPString(c.gid))
 
-	srcFileInfo, err := os.Lstat(src)
+	srcFileInfo, err := c.lstatSrc(src)
 	if err != nil {
 		return fmt.Errorf("error getting stat for path %q: %w", src, err)
 	}
 
+	followed := srcFileInfo.Mode()&os.ModeSymlink != 0 && c.symlinks == SymlinkFollow
+	if followed {
+		linkDestination, err := c.readSrcLink(src)
+		if err != nil {
+			return fmt.Errorf("error reading symlink %q: %w", src, err)
+		}
+
+		if _, keep, err := c.processEscapingSymlink(ctx, src, linkDestination); err != nil {
+			return fmt.Errorf("error processing symlink: %w", err)
+		} else if !keep {
+			return nil
+		}
+
+		srcFileInfo, followedFrom, err = c.followSymlink(ctx, src, followedFrom)
+		if err != nil {
+			return fmt.Errorf("error following symlink: %w", err)
+		}
+	}
+
 	switch {
 	case srcFileInfo.IsDir():
-		if err := walkPath(ctx, src, func(entryRelPath string, dirEntry *fs.DirEntry, e error) error {
+		if err := c.walkPath(ctx, src, followed, func(entryRelPath string, dirEntry *fs.DirEntry, e error) error {
 			if e != nil {
 				return fmt.Errorf("error walking path: %w", e)
 			}
@@ -222,6 +689,15 @@ func (c *CopyRecurse) copyRecurse(ctx context.Context, src, dest string) error {
 			absEntryDestPath := filepath.Join(dest, entryRelPath)
 
 			logboek.Context(ctx).Debug().LogF("Walking path %q for copying.\n", absEntrySrcPath)
+			c.progress.update(absEntrySrcPath, func(progress *Progress) {
+				// Matched directory itself already walked while looking for matches, followed symlink also matched.
+				if entryRelPath != "." {
+					progress.EntriesWalked++
+					progress.EntriesMatched++
+				} else if !followed {
+					progress.EntriesMatched++
+				}
+			})
 
 			srcEntryFileInfo, err := (*dirEntry).Info()
 			if err != nil {
@@ -233,24 +709,56 @@ func (c *CopyRecurse) copyRecurse(ctx context.Context, src, dest string) error {
 				if err := c.createEmptyDirsChain(ctx, absEntryDestPath); err != nil {
 					return fmt.Errorf("error creating empty dirs chain: %w", err)
 				}
+
+				if c.mirror {
+					if err := c.mirrorDir(ctx, absEntrySrcPath, absEntryDestPath, true); err != nil {
+						return fmt.Errorf("error mirroring directory: %w", err)
+					}
+				}
 			case srcEntryFileInfo.Mode().IsRegular():
 				if err := c.createEmptyDirsChain(ctx, getParentDir(absEntryDestPath)); err != nil {
 					return fmt.Errorf("error creating empty dirs chain: %w", err)
 				}
 
-				if err := c.copyFile(ctx, absEntrySrcPath, srcEntryFileInfo, srcEntryFileInfo.Sys().(*syscall.Stat_t), absEntryDestPath); err != nil {
+				if err := c.scheduleFileCopy(ctx, absEntrySrcPath, srcEntryFileInfo, getFileStat(srcEntryFileInfo), absEntryDestPath); err != nil {
 					return fmt.Errorf("error copying file: %w", err)
 				}
+			case srcEntryFileInfo.Mode()&os.ModeSymlink != 0 && c.symlinks == SymlinkFollow:
+				if err := c.copyRecurse(ctx, absEntrySrcPath, absEntryDestPath, followedFrom); err != nil {
+					return fmt.Errorf("error copying symlink target: %w", err)
+				}
 			case srcEntryFileInfo.Mode()&os.ModeSymlink != 0:
+				linkDestination, recreate, err := c.processSymlink(ctx, absEntrySrcPath)
+				if err != nil {
+					return fmt.Errorf("error processing symlink: %w", err)
+				} else if !recreate {
+					return nil
+				}
+
 				if err := c.createEmptyDirsChain(ctx, getParentDir(absEntryDestPath)); err != nil {
 					return fmt.Errorf("error creating empty dirs chain: %w", err)
 				}
 
-				if err := c.copySymlink(ctx, absEntrySrcPath, absEntryDestPath); err != nil {
+				if err := c.copySymlink(ctx, absEntrySrcPath, srcEntryFileInfo, linkDestination, absEntryDestPath); err != nil {
 					return fmt.Errorf("error copying symlink: %w", err)
 				}
+			case srcEntryFileInfo.Mode()&specialFileModeTypes != 0:
+				if recreate, err := c.processSpecialFile(ctx, absEntrySrcPath, srcEntryFileInfo, absEntryDestPath); err != nil {
+					return fmt.Errorf("error processing special file: %w", err)
+				} else if !recreate {
+					return nil
+				}
+
+				if err := c.createEmptyDirsChain(ctx, getParentDir(absEntryDestPath)); err != nil {
+					return fmt.Errorf("error creating empty dirs chain: %w", err)
+				}
+
+				if err := c.copySpecialFile(ctx, absEntrySrcPath, srcEntryFileInfo, absEntryDestPath); err != nil {
+					return fmt.Errorf("error copying special file: %w", err)
+				}
 			default:
 				logboek.Context(ctx).Warn().LogF("File %q is of a type %q. Copying of such a type is not supported, skipping.\n", absEntrySrcPath, srcEntryFileInfo.Mode().Type().String())
+				c.updateResult(func(result *Result) { result.Skipped++ })
 			}
 
 			return nil
@@ -258,10 +766,7 @@ func (c *CopyRecurse) copyRecurse(ctx context.Context, src, dest string) error {
 			return fmt.Errorf("error walking path: %w", err)
 		}
 	case srcFileInfo.Mode().IsRegular():
-		var srcStat *syscall.Stat_t
-		if c.uid == nil || c.gid == nil {
-			srcStat = srcFileInfo.Sys().(*syscall.Stat_t)
-		}
+		srcStat := getFileStat(srcFileInfo)
 
 		if dest != c.dest {
 			if err := c.createEmptyDirsChain(ctx, getParentDir(dest)); err != nil {
@@ -269,21 +774,45 @@ func (c *CopyRecurse) copyRecurse(ctx context.Context, src, dest string) error {
 			}
 		}
 
-		if err := c.copyFile(ctx, src, srcFileInfo, srcStat, dest); err != nil {
+		if err := c.scheduleFileCopy(ctx, src, srcFileInfo, srcStat, dest); err != nil {
 			return fmt.Errorf("error copying file: %w", err)
 		}
 	case srcFileInfo.Mode()&os.ModeSymlink != 0:
+		linkDestination, recreate, err := c.processSymlink(ctx, src)
+		if err != nil {
+			return fmt.Errorf("error processing symlink: %w", err)
+		} else if !recreate {
+			return nil
+		}
+
 		if dest != c.dest {
 			if err := c.createEmptyDirsChain(ctx, getParentDir(dest)); err != nil {
 				return fmt.Errorf("error creating empty dirs chain: %w", err)
 			}
 		}
 
-		if err := c.copySymlink(ctx, src, dest); err != nil {
+		if err := c.copySymlink(ctx, src, srcFileInfo, linkDestination, dest); err != nil {
 			return fmt.Errorf("error copying symlink: %w", err)
 		}
+	case srcFileInfo.Mode()&specialFileModeTypes != 0:
+		if recreate, err := c.processSpecialFile(ctx, src, srcFileInfo, dest); err != nil {
+			return fmt.Errorf("error processing special file: %w", err)
+		} else if !recreate {
+			return nil
+		}
+
+		if dest != c.dest {
+			if err := c.createEmptyDirsChain(ctx, getParentDir(dest)); err != nil {
+				return fmt.Errorf("error creating empty dirs chain: %w", err)
+			}
+		}
+
+		if err := c.copySpecialFile(ctx, src, srcFileInfo, dest); err != nil {
+			return fmt.Errorf("error copying special file: %w", err)
+		}
 	default:
 		logboek.Context(ctx).Warn().LogF("File %q is of a type %q. Copying of such a type is not supported, skipping.\n", src, srcFileInfo.Mode().Type().String())
+		c.updateResult(func(result *Result) { result.Skipped++ })
 	}
 
 	return nil
@@ -292,10 +821,11 @@ func (c *CopyRecurse) copyRecurse(ctx context.Context, src, dest string) error {
 func (c *CopyRecurse) createEmptyDirsChain(ctx context.Context, destPath string) error {
 	logboek.Context(ctx).Debug().LogF("Going to create empty dirs chain (if needed) for path %q.\n", destPath)
 
-	for _, visitedDir := range c.visitedDestDirs {
-		if visitedDir == destPath {
-			return nil
-		}
+	c.visitedDestDirsMu.Lock()
+	defer c.visitedDestDirsMu.Unlock()
+
+	if _, ok := c.visitedDestDirs[destPath]; ok {
+		return nil
 	}
 
 	dirsToVisit := []string{c.dest}
@@ -308,35 +838,25 @@ func (c *CopyRecurse) createEmptyDirsChain(ctx context.Context, destPath string)
 
 		relDestPathParts := strings.Split(relDestPath, string(filepath.Separator))
 		for i := 0; i < len(relDestPathParts); i++ {
-			dirsToVisit = append([]string{filepath.Join(c.dest, filepath.Join(relDestPathParts[:i+1]...))}, dirsToVisit...)
+			dirsToVisit = append(dirsToVisit, filepath.Join(c.dest, filepath.Join(relDestPathParts[:i+1]...)))
 		}
 	}
 
-	for _, visitedDir := range c.visitedDestDirs {
-		if len(dirsToVisit) == 0 {
-			return nil
-		}
-
-		for i, dirToVisit := range dirsToVisit {
-			if dirToVisit == visitedDir {
-				if i == 0 {
-					return nil
-				}
-				dirsToVisit = dirsToVisit[:i+1]
-				break
-			}
+	// Only dirs below the deepest already visited one should be created.
+	for i := len(dirsToVisit) - 1; i >= 0; i-- {
+		if _, ok := c.visitedDestDirs[dirsToVisit[i]]; ok {
+			dirsToVisit = dirsToVisit[i+1:]
+			break
 		}
 	}
 
-	sort.Slice(dirsToVisit, func(i, j int) bool { return i > j })
-
 	for _, dir := range dirsToVisit {
 		if err := c.createEmptyDirInChain(ctx, dir); err != nil {
 			return fmt.Errorf("error creating empty dir %q: %w", destPath, err)
 		}
-	}
 
-	c.visitedDestDirs = append(c.visitedDestDirs, dirsToVisit...)
+		c.visitedDestDirs[dir] = struct{}{}
+	}
 
 	return nil
 }
@@ -351,139 +871,1560 @@ func (c *CopyRecurse) createEmptyDirInChain(ctx context.Context, destPath string
 
 	srcPath := filepath.Join(c.src, relEntryPath)
 
-	srcFileInfo, err := os.Lstat(srcPath)
+	// Source directory can be a followed symlink.
+	srcFileInfo, err := c.statSrc(srcPath)
 	if err != nil {
 		return fmt.Errorf("error getting file info for %q: %w", relEntryPath, err)
 	}
 
 	var srcStat *syscall.Stat_t
 	if c.uid == nil || c.gid == nil {
-		srcStat = srcFileInfo.Sys().(*syscall.Stat_t)
+		srcStat = getFileStat(srcFileInfo)
 	}
 
-	destFileInfo, err := os.Lstat(destPath)
+	mode := getModeBits(srcFileInfo.Mode())
+	// Chown can clear setuid/setgid bits, so such modes are always set after chown.
+	needChmod := mode&specialModeBits != 0
+	// Directory not writable by owner made writable until all of its entries written.
+	writableMode := mode | ownerRWXBits
+
+	destFileInfo, err := c.lstatDest(destPath)
 	if errors.Is(err, os.ErrNotExist) {
-		logboek.Context(ctx).Debug().LogF("Creating dir %q with perms %s.\n", destPath, srcFileInfo.Mode().Perm())
-		if err := os.Mkdir(destPath, srcFileInfo.Mode().Perm()); err != nil {
+		logboek.Context(ctx).Debug().LogF("Creating dir %q with perms %s.\n", destPath, writableMode.Perm())
+		if err := c.mkdir(destPath, writableMode.Perm()); err != nil {
 			return fmt.Errorf("error creating directory %q: %w", destPath, err)
 		}
+		// Mkdir applies umask and ignores setuid/setgid bits.
+		needChmod = true
 	} else if err != nil {
 		return fmt.Errorf("can't get file info for %q: %w", destPath, err)
 	} else if !destFileInfo.IsDir() {
 		logboek.Context(ctx).Debug().LogF("Removing path %q.\n", destPath)
-		if err := os.RemoveAll(destPath); err != nil {
+		if err := c.removeAll(destPath); err != nil {
 			return fmt.Errorf("error removing path %q: %w", destPath, err)
 		}
 
-		logboek.Context(ctx).Debug().LogF("Creating dir %q with perms %s.\n", destPath, srcFileInfo.Mode().Perm())
-		if err := os.Mkdir(destPath, srcFileInfo.Mode().Perm()); err != nil {
+		logboek.Context(ctx).Debug().LogF("Creating dir %q with perms %s.\n", destPath, writableMode.Perm())
+		if err := c.mkdir(destPath, writableMode.Perm()); err != nil {
 			return fmt.Errorf("error creating directory %q: %w", destPath, err)
 		}
-	} else if srcFileInfo.Mode().Perm() != destFileInfo.Mode().Perm() {
-		logboek.Context(ctx).Debug().LogF("Setting perms of already present dir %q to %s.\n", destPath, srcFileInfo.Mode().Perm())
-		if err := os.Chmod(destPath, srcFileInfo.Mode().Perm()); err != nil {
-			return fmt.Errorf("error changing permissions for %q to %s: %w", destPath, srcFileInfo.Mode().Perm(), err)
-		}
+		// Mkdir applies umask and ignores setuid/setgid bits.
+		needChmod = true
+	} else if mode != getModeBits(destFileInfo.Mode()) {
+		needChmod = true
 	}
 
 	if err := c.processDirOwnership(ctx, destPath, srcStat); err != nil {
 		return fmt.Errorf("error processing dir ownership: %w", err)
 	}
 
-	return nil
-}
+	pendingDir := pendingDestDir{path: destPath}
 
-func (c *CopyRecurse) copyFile(ctx context.Context, src string, srcFileInfo os.FileInfo, srcStat *syscall.Stat_t, dest string) error {
+	if writableMode != mode {
+		logboek.Context(ctx).Debug().LogF("Setting mode of dir %q to %s until all of its entries written.\n", destPath, writableMode)
+		if err := c.chmod(destPath, writableMode); err != nil {
+			return fmt.Errorf("error changing mode for %q to %s: %w", destPath, writableMode, err)
+		}
+
+		pendingDir.setMode = true
+		pendingDir.mode = mode
+	} else if needChmod {
+		logboek.Context(ctx).Debug().LogF("Setting mode of dir %q to %s.\n", destPath, mode)
+		if err := c.chmod(destPath, mode); err != nil {
+			return fmt.Errorf("error changing mode for %q to %s: %w", destPath, mode, err)
+		}
+	}
+
+	if c.copyXattrs && !c.planning {
+		if err := c.processXattrs(ctx, srcPath, destPath); err != nil {
+			return fmt.Errorf("error processing dir extended attributes: %w", err)
+		}
+	}
+
+	if c.preserveTimes && !c.planning {
+		pendingDir.setTimes = true
+		pendingDir.atime = getAtime(srcFileInfo)
+		pendingDir.mtime = srcFileInfo.ModTime()
+	}
+
+	if pendingDir.setMode || pendingDir.setTimes {
+		c.pendingDestDirs = append(c.pendingDestDirs, pendingDir)
+	}
+
+	c.updateResult(func(result *Result) { result.Dirs++ })
+
+	return nil
+}
+
+// Returns file info of dest if it is the same as src according to compare method, otherwise nil.
+func (c *CopyRecurse) getUnchangedDestFileInfo(ctx context.Context, src string, srcFileInfo os.FileInfo, srcStat *syscall.Stat_t, dest string) (os.FileInfo, error) {
+	destFileInfo, err := c.lstatDest(dest)
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error getting file info for %q: %w", dest, err)
+	}
+
+	if !destFileInfo.Mode().IsRegular() || destFileInfo.Size() != srcFileInfo.Size() {
+		return nil, nil
+	}
+
+	switch c.compareMethod {
+	case CompareSizeAndModTime:
+		if !destFileInfo.ModTime().Equal(srcFileInfo.ModTime()) {
+			return nil, nil
+		}
+	case CompareSizeModTimeModeAndOwner:
+		destStat := getFileStat(destFileInfo)
+		uid, gid := getNewUIDAndGID(c.uid, c.gid, srcStat)
+
+		if !destFileInfo.ModTime().Equal(srcFileInfo.ModTime()) ||
+			getModeBits(destFileInfo.Mode()) != getModeBits(srcFileInfo.Mode()) ||
+			int(destStat.Uid) != uid || int(destStat.Gid) != gid {
+			return nil, nil
+		}
+	case CompareContent:
+		logboek.Context(ctx).Debug().LogF("Comparing content of %q and %q.\n", src, dest)
+
+		srcFile, err := c.openSrc(src)
+		if err != nil {
+			return nil, fmt.Errorf("error opening file %q: %w", src, err)
+		}
+		defer srcFile.Close()
+
+		srcHash, err := hashFile(src, srcFile, sha256.New)
+		if err != nil {
+			return nil, err
+		}
+
+		destFile, err := c.openDestFile(dest, os.O_RDONLY, 0)
+		if err != nil {
+			return nil, fmt.Errorf("error opening file %q: %w", dest, err)
+		}
+		defer destFile.Close()
+
+		destHash, err := hashFile(dest, destFile, sha256.New)
+		if err != nil {
+			return nil, err
+		}
+
+		if !bytes.Equal(srcHash, destHash) {
+			return nil, nil
+		}
+	default:
+		panic(fmt.Sprintf("unexpected compare method (int %d)", c.compareMethod))
+	}
+
+	return destFileInfo, nil
+}
+
+// Sets ownership, mode, extended attributes and times of unchanged dest file only if they differ from src.
+func (c *CopyRecurse) updateUnchangedFileMetadata(ctx context.Context, src string, srcFileInfo os.FileInfo, srcStat *syscall.Stat_t, dest string, destFileInfo os.FileInfo) error {
+	logboek.Context(ctx).Debug().LogF("File %q is unchanged, updating its metadata only.\n", dest)
+
+	destStat := getFileStat(destFileInfo)
+	uid, gid := getNewUIDAndGID(c.uid, c.gid, srcStat)
+
+	ownerChanged := int(destStat.Uid) != uid || int(destStat.Gid) != gid
+	if ownerChanged {
+		logboek.Context(ctx).Debug().LogF("Changing file %q ownership to %d/%d.\n", dest, uid, gid)
+		if err := c.lchown(dest, uid, gid); err != nil {
+			return fmt.Errorf("error changing ownership for %q: %w", dest, err)
+		}
+	}
+
+	// Chown can clear setuid/setgid bits, so setting mode after it.
+	mode := getModeBits(srcFileInfo.Mode())
+	if ownerChanged || mode != getModeBits(destFileInfo.Mode()) {
+		logboek.Context(ctx).Debug().LogF("Chmod destination file %q to %s.\n", dest, mode)
+		if err := c.chmod(dest, mode); err != nil {
+			return fmt.Errorf("error changing mode for file %q to %s: %w", dest, mode, err)
+		}
+	}
+
+	if c.copyXattrs && !c.planning {
+		if err := c.processXattrs(ctx, src, dest); err != nil {
+			return fmt.Errorf("error processing file extended attributes: %w", err)
+		}
+	}
+
+	if c.preserveTimes && !c.planning && !destFileInfo.ModTime().Equal(srcFileInfo.ModTime()) {
+		if err := c.setTimes(ctx, dest, getAtime(srcFileInfo), srcFileInfo.ModTime()); err != nil {
+			return fmt.Errorf("error setting file times: %w", err)
+		}
+	}
+
+	c.updateResult(func(result *Result) { result.Unchanged++ })
+
+	return nil
+}
+
+// Sets extended attributes and times of unchanged dest symlink only if they differ from src.
+func (c *CopyRecurse) updateUnchangedSymlinkMetadata(ctx context.Context, src string, srcFileInfo os.FileInfo, dest string, destFileInfo os.FileInfo) error {
+	logboek.Context(ctx).Debug().LogF("Symlink %q is unchanged, updating its metadata only.\n", dest)
+
+	if c.copyXattrs && !c.planning {
+		if err := c.processXattrs(ctx, src, dest); err != nil {
+			return fmt.Errorf("error processing symlink extended attributes: %w", err)
+		}
+	}
+
+	if c.preserveTimes && !c.planning && !destFileInfo.ModTime().Equal(srcFileInfo.ModTime()) {
+		if err := c.setTimes(ctx, dest, getAtime(srcFileInfo), srcFileInfo.ModTime()); err != nil {
+			return fmt.Errorf("error setting symlink times: %w", err)
+		}
+	}
+
+	c.updateResult(func(result *Result) { result.Unchanged++ })
+
+	return nil
+}
+
+func hashFile(path string, file io.Reader, newHash func() hash.Hash) ([]byte, error) {
+	fileHash := newHash()
+	if _, err := io.Copy(fileHash, file); err != nil {
+		return nil, fmt.Errorf("error reading file %q: %w", path, err)
+	}
+
+	return fileHash.Sum(nil), nil
+}
+
+func (c *CopyRecurse) isSameDestFile(path1, path2 string) (bool, error) {
+	fileInfo1, err := c.lstatDest(path1)
+	if err != nil {
+		return false, fmt.Errorf("error getting file info for %q: %w", path1, err)
+	}
+
+	fileInfo2, err := c.lstatDest(path2)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("error getting file info for %q: %w", path2, err)
+	}
+
+	return isSameFile(fileInfo1, fileInfo2), nil
+}
+
+// Removes entries of dest dir that have no corresponding entries in src dir. If matchAll is false, then only entries that
+// would be matched if they were in src dir are removed, and not matched directories are mirrored recursively.
+func (c *CopyRecurse) mirrorDir(ctx context.Context, srcDir, destDir string, matchAll bool) error {
+	logboek.Context(ctx).Debug().LogF("Mirroring dir %q to %q.\n", srcDir, destDir)
+
+	// Directory that would be created is empty.
+	if _, ok := c.plannedDirs[destDir]; ok {
+		return nil
+	}
+
+	if _, err := c.lstatDest(destDir); errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error getting file info for %q: %w", destDir, err)
+	}
+
+	destEntries, err := c.readDestDir(destDir)
+	if errors.Is(err, syscall.ENOTDIR) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error reading dir %q: %w", destDir, err)
+	}
+
+	for _, destEntry := range destEntries {
+		srcPath := filepath.Join(srcDir, destEntry.Name())
+		destPath := filepath.Join(destDir, destEntry.Name())
+
+		if _, err := c.lstatSrc(srcPath); err == nil {
+			continue
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("error getting file info for %q: %w", srcPath, err)
+		}
+
+		if c.mirrorProtect != nil {
+			if protected, err := c.mirrorProtect(destPath); err != nil {
+				return fmt.Errorf("error checking whether %q protected: %w", destPath, err)
+			} else if protected {
+				logboek.Context(ctx).Debug().LogF("Keeping protected path %q missing in source.\n", destPath)
+				continue
+			}
+		}
+
+		if !matchAll {
+			if destEntry.IsDir() {
+				action, err := c.matchDir(srcPath)
+				if err != nil {
+					return fmt.Errorf("error matching directory %q: %w", srcPath, err)
+				}
+
+				switch action {
+				case DirMatch:
+					// Removed with all of its contents below.
+				case DirFallThrough:
+					if err := c.mirrorDir(ctx, srcPath, destPath, false); err != nil {
+						return err
+					}
+					continue
+				case DirSkip:
+					continue
+				default:
+					panic(fmt.Sprintf("unexpected action (int %d)", action))
+				}
+			} else if match, err := c.matchFile(srcPath); err != nil {
+				return fmt.Errorf("error matching file %q: %w", srcPath, err)
+			} else if !match {
+				continue
+			}
+		}
+
+		logboek.Context(ctx).Debug().LogF("Removing path %q missing in source.\n", destPath)
+		if c.planning {
+			c.addPlanAction(PlanAction{Type: PlanActionRemove, Path: destPath})
+		} else if err := c.removeDestAll(destPath); err != nil {
+			return fmt.Errorf("error removing path %q: %w", destPath, err)
+		}
+
+		c.updateResult(func(result *Result) { result.Removed++ })
+	}
+
+	return nil
+}
+
+// Copies file in one of workers if running with concurrency, otherwise copies it right away.
+func (c *CopyRecurse) scheduleFileCopy(ctx context.Context, src string, srcFileInfo os.FileInfo, srcStat *syscall.Stat_t, dest string) error {
+	if c.workers == nil {
+		return c.copyFile(ctx, src, srcFileInfo, srcStat, dest)
+	}
+
+	logboek.Context(ctx).Debug().LogF("Scheduling copying of file %q to %q.\n", src, dest)
+	return c.workers.submit(func(ctx context.Context) error {
+		if err := c.copyFile(ctx, src, srcFileInfo, srcStat, dest); err != nil {
+			return fmt.Errorf("error copying file %q: %w", src, err)
+		}
+		return nil
+	})
+}
+
+func (c *CopyRecurse) copyFile(ctx context.Context, src string, srcFileInfo os.FileInfo, srcStat *syscall.Stat_t, dest string) (err error) {
 	logboek.Context(ctx).Debug().LogF("Going to copy file %q to %q with UID/GID %v/%v.\n", src, dest, uint32PtrPString(c.uid), uint32PtrPString(c.gid))
 
-	logboek.Context(ctx).Debug().LogF("Opening source file %q.\n", src)
-	srcFile, err := os.Open(src)
+	if c.preserveHardLinks && srcStat.Nlink > 1 {
+		key := hardLinkKey{dev: uint64(srcStat.Dev), ino: uint64(srcStat.Ino)}
+
+		c.hardLinksMu.Lock()
+		link, linked := c.hardLinks[key]
+		if !linked {
+			link = &hardLink{target: dest, done: make(chan struct{})}
+			c.hardLinks[key] = link
+		}
+		c.hardLinksMu.Unlock()
+
+		if linked {
+			// Link target might be still copying in another worker.
+			select {
+			case <-link.done:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+
+			if link.err != nil {
+				return fmt.Errorf("error copying hard link target %q: %w", link.target, link.err)
+			}
+
+			return c.linkFile(ctx, src, link.target, dest)
+		}
+
+		defer func() {
+			link.err = err
+			close(link.done)
+		}()
+	}
+
+	if c.compareMethod != CompareNone {
+		if destFileInfo, err := c.getUnchangedDestFileInfo(ctx, src, srcFileInfo, srcStat, dest); err != nil {
+			return fmt.Errorf("error comparing file %q with %q: %w", src, dest, err)
+		} else if destFileInfo != nil {
+			return c.updateUnchangedFileMetadata(ctx, src, srcFileInfo, srcStat, dest, destFileInfo)
+		}
+	}
+
+	if c.planning {
+		return c.planFileCopy(ctx, src, srcFileInfo, srcStat, dest)
+	}
+
+	logboek.Context(ctx).Debug().LogF("Opening source file %q.\n", src)
+	srcFile, err := c.openSrc(src)
+	if err != nil {
+		return fmt.Errorf("error opening file %q: %w", src, err)
+	}
+	defer srcFile.Close()
+
+	// Temporary file path with AtomicReplace.
+	destPath := dest
+	var destFile DestFile
+	if c.atomicReplace {
+		logboek.Context(ctx).Debug().LogF("Creating temporary destination file for %q with perms %s.\n", dest, srcFileInfo.Mode().Perm())
+		destPath, err = createTempDestEntry(dest, func(tmpPath string) error {
+			var err error
+			destFile, err = c.openDestFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, srcFileInfo.Mode().Perm())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("error creating temporary file for %q: %w", dest, err)
+		}
+
+		// Named result checked, so that the temporary file removed on any error below.
+		defer func() {
+			if err != nil {
+				c.removeDestAll(destPath)
+			}
+		}()
+	} else {
+		_, err = c.lstatDest(dest)
+		if err == nil {
+			logboek.Context(ctx).Debug().LogF("Removing path %q.\n", dest)
+			if err := c.removeAll(dest); err != nil {
+				return fmt.Errorf("error removing path %q: %w", dest, err)
+			}
+		}
+
+		logboek.Context(ctx).Debug().LogF("Creating destination file %q with perms %s.\n", dest, srcFileInfo.Mode().Perm())
+		destFile, err = c.openDestFile(dest, os.O_RDWR|os.O_CREATE|os.O_TRUNC, srcFileInfo.Mode().Perm())
+		if err != nil {
+			return fmt.Errorf("error creating file %q: %w", dest, err)
+		}
+	}
+	defer destFile.Close()
+
+	if err := c.processFileOwnership(ctx, srcStat, destPath, destFile); err != nil {
+		return fmt.Errorf("error processing file ownership: %w", err)
+	}
+
+	logboek.Context(ctx).Debug().LogF("Copying file contents from %q to %q.\n", src, dest)
+	var srcHash hash.Hash
+	if c.verifyContent {
+		srcHash = c.verifyHash()
+	}
+
+	method, srcHashed, err := c.copyFileData(ctx, src, srcFile, destPath, destFile, srcFileInfo.Size(), srcHash)
+	if err != nil {
+		return fmt.Errorf("error copying file from %q to %q: %w", src, dest, err)
+	}
+
+	if c.onFileDataCopied != nil {
+		c.onFileDataCopied(src, dest, method)
+	}
+
+	if c.verifyContent {
+		if err := c.verifyFileContent(ctx, src, srcFile, srcHash, srcHashed, dest, destPath, destFile); err != nil {
+			return fmt.Errorf("error verifying content of file %q: %w", dest, err)
+		}
+	}
+
+	// Writing file data and changing ownership clear security.capability, so copying extended attributes after.
+	if c.copyXattrs {
+		if err := c.processXattrs(ctx, src, destPath); err != nil {
+			return fmt.Errorf("error processing file extended attributes: %w", err)
+		}
+	}
+
+	// Writing file data and changing ownership clear setuid/setgid bits, so setting mode after.
+	mode := getModeBits(srcFileInfo.Mode())
+	logboek.Context(ctx).Debug().LogF("Chmod destination file %q to %s.\n", dest, mode)
+	if osFile, ok := destFile.(*os.File); ok {
+		err = osFile.Chmod(mode)
+	} else {
+		err = c.chmod(destPath, mode)
+	}
+	if err != nil {
+		return fmt.Errorf("error changing mode for file %q to %s: %w", dest, mode, err)
+	}
+
+	if c.preserveTimes {
+		if err := c.setFileTimes(ctx, destPath, destFile, getAtime(srcFileInfo), srcFileInfo.ModTime()); err != nil {
+			return fmt.Errorf("error setting file times: %w", err)
+		}
+	}
+
+	if c.atomicReplace {
+		if err := c.renameTempDestEntry(ctx, destPath, dest); err != nil {
+			return fmt.Errorf("error replacing %q with temporary file: %w", dest, err)
+		}
+	}
+
+	c.updateResult(func(result *Result) {
+		result.Files++
+		result.Bytes += srcFileInfo.Size()
+	})
+	c.progress.update(src, func(progress *Progress) {
+		progress.FilesCopied++
+		progress.BytesCopied += srcFileInfo.Size()
+	})
+
+	return nil
+}
+
+// If srcHash is not nil, then copied data written to it too when possible, srcHashed reports whether it was.
+func (c *CopyRecurse) copyFileData(ctx context.Context, src string, srcFile fs.File, dest string, destFile DestFile, size int64, srcHash hash.Hash) (method CopyMethod, srcHashed bool, err error) {
+	srcOSFile, isSrcOSFile := srcFile.(*os.File)
+	destOSFile, isDestOSFile := destFile.(*os.File)
+
+	for _, method := range c.copyMethods {
+		logboek.Context(ctx).Debug().LogF("Trying to copy file data from %q to %q with method %s.\n", src, dest, method)
+
+		switch {
+		case (!isSrcOSFile || !isDestOSFile) && method != CopyMethodUserspace:
+			// Kernel copy methods need file descriptors, files of fs.FS or Dest might have none.
+			err = fmt.Errorf("source or destination is not an OS file: %w", errCopyMethodNotSupported)
+		case method == CopyMethodUserspace && (!c.preserveSparseFiles || !isSrcOSFile || !isDestOSFile):
+			// Copying till EOF, so that data appended after getting file size not lost.
+			var srcReader io.Reader = srcFile
+			if srcHash != nil {
+				srcReader = io.TeeReader(srcFile, srcHash)
+				srcHashed = true
+			}
+			err = copyFileDataInUserspace(srcReader, destFile)
+		case c.preserveSparseFiles:
+			err = copySparseFileDataWithMethod(method, srcOSFile, destOSFile, size)
+		default:
+			err = copyFileDataWithMethod(method, srcOSFile, destOSFile, size)
+		}
+
+		if errors.Is(err, errCopyMethodNotSupported) {
+			logboek.Context(ctx).Debug().LogF("Copy method %s is not supported for %q: %s.\n", method, dest, err)
+			continue
+		} else if err != nil {
+			return method, false, fmt.Errorf("error copying file data with method %s: %w", method, err)
+		}
+
+		logboek.Context(ctx).Debug().LogF("File data copied from %q to %q with method %s.\n", src, dest, method)
+		return method, srcHashed, nil
+	}
+
+	return 0, false, fmt.Errorf("none of copy methods %v is supported", c.copyMethods)
+}
+
+// Dest path is the one to report, destPath is the actual path of destFile, e.g. a temporary one. If source is not
+// hashed yet, then it is read once more into srcHash.
+func (c *CopyRecurse) verifyFileContent(ctx context.Context, src string, srcFile fs.File, srcHash hash.Hash, srcHashed bool, dest, destPath string, destFile DestFile) error {
+	logboek.Context(ctx).Debug().LogF("Verifying content of %q.\n", dest)
+
+	// Kernel copy methods don't pass data through userspace, so source read once more to hash it.
+	if !srcHashed {
+		var srcReader io.Reader
+		if srcReaderAt, ok := srcFile.(io.ReaderAt); ok {
+			srcReader = io.NewSectionReader(srcReaderAt, 0, math.MaxInt64)
+		} else {
+			// Source file of fs.FS can't be read from the start again, so opening it once more.
+			reopenedSrcFile, err := c.openSrc(src)
+			if err != nil {
+				return fmt.Errorf("error opening file %q: %w", src, err)
+			}
+			defer reopenedSrcFile.Close()
+
+			srcReader = reopenedSrcFile
+		}
+
+		if _, err := io.Copy(srcHash, srcReader); err != nil {
+			return fmt.Errorf("error reading file %q: %w", src, err)
+		}
+	}
+
+	// Otherwise written data could be read back from page cache instead of storage.
+	if destOSFile, ok := destFile.(*os.File); ok {
+		if err := dropFileCache(destOSFile); err != nil {
+			return fmt.Errorf("error dropping cached data of file %q: %w", dest, err)
+		}
+	}
+
+	var destReader io.Reader
+	if destReaderAt, ok := destFile.(io.ReaderAt); ok {
+		destReader = io.NewSectionReader(destReaderAt, 0, math.MaxInt64)
+	} else {
+		reopenedDestFile, err := c.openDestFile(destPath, os.O_RDONLY, 0)
+		if err != nil {
+			return fmt.Errorf("error opening file %q: %w", dest, err)
+		}
+		defer reopenedDestFile.Close()
+
+		destReader = reopenedDestFile
+	}
+
+	destHash := c.verifyHash()
+	if _, err := io.Copy(destHash, destReader); err != nil {
+		return fmt.Errorf("error reading file %q: %w", dest, err)
+	}
+
+	if srcChecksum, destChecksum := srcHash.Sum(nil), destHash.Sum(nil); !bytes.Equal(srcChecksum, destChecksum) {
+		return &ChecksumMismatchError{
+			Src:          src,
+			Dest:         dest,
+			SrcChecksum:  srcChecksum,
+			DestChecksum: destChecksum,
+		}
+	}
+
+	return nil
+}
+
+// Copies till EOF of srcFile.
+func copyFileDataInUserspace(srcFile io.Reader, destFile io.Writer) error {
+	// Hide ReaderFrom/WriterTo implementations of *os.File, otherwise io.Copy can use copy_file_range, splice or sendfile.
+	_, err := io.Copy(struct{ io.Writer }{destFile}, struct{ io.Reader }{srcFile})
+	return err
+}
+
+func (c *CopyRecurse) linkFile(ctx context.Context, src, linkTarget, dest string) error {
+	logboek.Context(ctx).Debug().LogF("Going to hard link %q to already copied %q.\n", dest, linkTarget)
+
+	// Otherwise the only copy would be removed if the same file processed twice.
+	if linkTarget == dest {
+		logboek.Context(ctx).Debug().LogF("File %q is already copied.\n", dest)
+		return nil
+	}
+
+	if c.compareMethod != CompareNone && !c.planning {
+		if same, err := c.isSameDestFile(linkTarget, dest); err != nil {
+			return fmt.Errorf("error comparing %q with %q: %w", dest, linkTarget, err)
+		} else if same {
+			logboek.Context(ctx).Debug().LogF("Hard link %q to %q already exists.\n", dest, linkTarget)
+			c.updateResult(func(result *Result) { result.Unchanged++ })
+			return nil
+		}
+	}
+
+	if c.atomicReplace && !c.planning {
+		logboek.Context(ctx).Debug().LogF("Replacing %q with hard link to %q.\n", dest, linkTarget)
+		if err := c.replaceAtomically(ctx, dest, func(tmpPath string) error {
+			return c.link(linkTarget, tmpPath)
+		}); err != nil {
+			return fmt.Errorf("error creating hard link %q to %q: %w", dest, linkTarget, err)
+		}
+	} else {
+		logboek.Context(ctx).Debug().LogF("Removing path %q.\n", dest)
+		if err := c.removeAll(dest); err != nil {
+			return fmt.Errorf("error removing path %q: %w", dest, err)
+		}
+
+		logboek.Context(ctx).Debug().LogF("Creating hard link %q to %q.\n", dest, linkTarget)
+		if err := c.link(linkTarget, dest); err != nil {
+			return fmt.Errorf("error creating hard link %q to %q: %w", dest, linkTarget, err)
+		}
+	}
+
+	c.updateResult(func(result *Result) { result.Files++ })
+	c.progress.update(src, func(progress *Progress) { progress.FilesCopied++ })
+
+	return nil
+}
+
+func (c *CopyRecurse) copySymlink(ctx context.Context, src string, srcFileInfo os.FileInfo, linkDestination, dest string) error {
+	logboek.Context(ctx).Debug().LogF("Going to copy symlink %q to %q with destination %q and UID/GID %v/%v.\n", src, dest, linkDestination, uint32PtrPString(c.uid), uint32PtrPString(c.gid))
+
+	if c.compareMethod != CompareNone {
+		if destFileInfo, err := c.lstatDest(dest); err == nil && destFileInfo.Mode()&os.ModeSymlink != 0 {
+			if destLinkDestination, err := c.readDestLink(dest); err != nil {
+				return fmt.Errorf("error reading symlink %q: %w", dest, err)
+			} else if destLinkDestination == linkDestination {
+				return c.updateUnchangedSymlinkMetadata(ctx, src, srcFileInfo, dest, destFileInfo)
+			}
+		}
+	}
+
+	if c.atomicReplace && !c.planning {
+		logboek.Context(ctx).Debug().LogF("Replacing %q with symlink to %q.\n", dest, linkDestination)
+		if err := c.replaceAtomically(ctx, dest, func(tmpPath string) error {
+			return c.symlink(linkDestination, tmpPath)
+		}); err != nil {
+			return fmt.Errorf("error creating symlink %q: %w", dest, err)
+		}
+	} else {
+		logboek.Context(ctx).Debug().LogF("Removing path %q.\n", dest)
+		if err := c.removeAll(dest); err != nil {
+			return fmt.Errorf("error removing path %q: %w", dest, err)
+		}
+
+		logboek.Context(ctx).Debug().LogF("Creating symlink from %q to %q.\n", dest, linkDestination)
+		if err := c.symlink(linkDestination, dest); err != nil {
+			return fmt.Errorf("error creating symlink %q: %w", dest, err)
+		}
+	}
+
+	if c.copyXattrs && !c.planning {
+		if err := c.processXattrs(ctx, src, dest); err != nil {
+			return fmt.Errorf("error processing symlink extended attributes: %w", err)
+		}
+	}
+
+	if c.preserveTimes && !c.planning {
+		if err := c.setTimes(ctx, dest, getAtime(srcFileInfo), srcFileInfo.ModTime()); err != nil {
+			return fmt.Errorf("error setting symlink times: %w", err)
+		}
+	}
+
+	c.updateResult(func(result *Result) { result.Symlinks++ })
+
+	return nil
+}
+
+// Decides whether a symlink should be recreated in destination and returns destination for it.
+func (c *CopyRecurse) processSymlink(ctx context.Context, src string) (string, bool, error) {
+	linkDestination, err := c.readSrcLink(src)
+	if err != nil {
+		return "", false, fmt.Errorf("error reading symlink %q: %w", src, err)
+	}
+
+	if newLinkDestination, keep, err := c.processEscapingSymlink(ctx, src, linkDestination); err != nil {
+		return "", false, err
+	} else if !keep {
+		return "", false, nil
+	} else if newLinkDestination != "" {
+		return newLinkDestination, true, nil
+	}
+
+	if c.symlinks == SymlinkRewriteAbsolute && filepath.IsAbs(linkDestination) && isPathInside(linkDestination, c.src) {
+		relLinkDestination, err := filepath.Rel(getParentDir(src), linkDestination)
+		if err != nil {
+			return "", false, fmt.Errorf("error calculating relative path for base %q and target %q: %w", getParentDir(src), linkDestination, err)
+		}
+
+		logboek.Context(ctx).Debug().LogF("Rewriting destination %q of symlink %q to %q.\n", linkDestination, src, relLinkDestination)
+		linkDestination = relLinkDestination
+	}
+
+	if c.symlinks == SymlinkSkipDangling {
+		if _, err := c.statSrc(src); errors.Is(err, os.ErrNotExist) {
+			logboek.Context(ctx).Debug().LogF("Skipping dangling symlink %q.\n", src)
+			c.updateResult(func(result *Result) { result.Skipped++ })
+			return "", false, nil
+		} else if err != nil {
+			return "", false, fmt.Errorf("error dereferencing symlink %q: %w", src, err)
+		}
+	}
+
+	return linkDestination, true, nil
+}
+
+// Decides what to do with a symlink if it points outside of source. Returns new destination for the symlink if it
+// should be rewritten and whether the symlink should be kept.
+func (c *CopyRecurse) processEscapingSymlink(ctx context.Context, src, linkDestination string) (string, bool, error) {
+	// Source itself is a symlink, nothing to escape.
+	if src == c.src || (c.escapingSymlinks == EscapingSymlinkAllow && c.onEscapingSymlink == nil) {
+		return "", true, nil
+	}
+
+	if _, inside, err := c.resolveInRoot(c.src, src, false); err != nil {
+		return "", false, fmt.Errorf("error resolving symlink %q: %w", src, err)
+	} else if inside {
+		return "", true, nil
+	}
+
+	if c.onEscapingSymlink != nil {
+		c.onEscapingSymlink(src, linkDestination, c.escapingSymlinks)
+	}
+
+	switch c.escapingSymlinks {
+	case EscapingSymlinkAllow:
+		return "", true, nil
+	case EscapingSymlinkSkip:
+		if c.onEscapingSymlink == nil {
+			logboek.Context(ctx).Warn().LogF("Symlink %q to %q points outside of source, skipping.\n", src, linkDestination)
+		}
+		c.updateResult(func(result *Result) { result.Skipped++ })
+		return "", false, nil
+	case EscapingSymlinkRewrite:
+		resolvedPath, _, err := c.resolveInRoot(c.src, src, true)
+		if err != nil {
+			return "", false, fmt.Errorf("error resolving symlink %q inside of %q: %w", src, c.src, err)
+		}
+
+		newLinkDestination, err := filepath.Rel(getParentDir(src), resolvedPath)
+		if err != nil {
+			return "", false, fmt.Errorf("error calculating relative path for base %q and target %q: %w", getParentDir(src), resolvedPath, err)
+		}
+
+		if c.onEscapingSymlink == nil {
+			logboek.Context(ctx).Warn().LogF("Symlink %q to %q points outside of source, rewriting its destination to %q.\n", src, linkDestination, newLinkDestination)
+		}
+		return newLinkDestination, true, nil
+	case EscapingSymlinkFail:
+		return "", false, fmt.Errorf("symlink %q to %q points outside of source", src, linkDestination)
+	default:
+		panic(fmt.Sprintf("unexpected escaping symlink action (int %d)", c.escapingSymlinks))
+	}
+}
+
+// Resolves path inside root following symlinks on the way like the kernel does, but missing path components resolved
+// lexically. If chroot is false, then returns false as soon as resolution gets outside of root. Otherwise root treated
+// as the root directory, so that resolution never gets outside of it.
+func (c *CopyRecurse) resolveInRoot(root, path string, chroot bool) (string, bool, error) {
+	relPath, err := filepath.Rel(root, path)
+	if err != nil {
+		return "", false, fmt.Errorf("error calculating relative path for base %q and target %q: %w", root, path, err)
+	}
+
+	current := root
+	components := strings.Split(relPath, string(filepath.Separator))
+	resolvedSymlinks := 0
+
+	for len(components) > 0 {
+		component := components[0]
+		components = components[1:]
+
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			if current == root {
+				if !chroot {
+					return "", false, nil
+				}
+				continue
+			}
+
+			current = getParentDir(current)
+			continue
+		}
+
+		next := filepath.Join(current, component)
+
+		fileInfo, err := c.lstatSrc(next)
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) || (err == nil && fileInfo.Mode()&os.ModeSymlink == 0) {
+			current = next
+			continue
+		} else if err != nil {
+			return "", false, fmt.Errorf("error getting file info for %q: %w", next, err)
+		}
+
+		resolvedSymlinks++
+		if resolvedSymlinks > maxResolvedSymlinks {
+			return "", false, fmt.Errorf("error resolving symlink %q: %w", next, syscall.ELOOP)
+		}
+
+		linkDestination, err := c.readSrcLink(next)
+		if err != nil {
+			return "", false, fmt.Errorf("error reading symlink %q: %w", next, err)
+		}
+
+		if filepath.IsAbs(linkDestination) {
+			if chroot {
+				current = root
+			} else if isPathInside(linkDestination, root) {
+				current = root
+				if linkDestination, err = filepath.Rel(root, linkDestination); err != nil {
+					return "", false, fmt.Errorf("error calculating relative path for base %q and target %q: %w", root, linkDestination, err)
+				}
+			} else {
+				return "", false, nil
+			}
+		}
+
+		components = append(strings.Split(linkDestination, string(filepath.Separator)), components...)
+	}
+
+	return current, true, nil
+}
+
+// Returns file info of symlink target. Symlinks to directories are checked for loops and depth, and real path of the
+// symlink directory is added to followedFrom.
+func (c *CopyRecurse) followSymlink(ctx context.Context, src string, followedFrom []string) (os.FileInfo, []string, error) {
+	logboek.Context(ctx).Debug().LogF("Following symlink %q.\n", src)
+
+	targetFileInfo, err := os.Stat(src)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error dereferencing symlink %q: %w", src, err)
+	}
+
+	if !targetFileInfo.IsDir() {
+		return targetFileInfo, followedFrom, nil
+	}
+
+	if len(followedFrom) >= c.maxSymlinkDepth {
+		return nil, nil, fmt.Errorf("symlink %q exceeds max depth %d of nested symlinks to directories", src, c.maxSymlinkDepth)
+	}
+
+	realTargetPath, err := filepath.EvalSymlinks(src)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error resolving symlink %q: %w", src, err)
+	}
+
+	realSymlinkDir, err := filepath.EvalSymlinks(getParentDir(src))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error resolving path %q: %w", getParentDir(src), err)
+	}
+
+	// Copying directory containing the symlink itself never ends.
+	followedFrom = append(followedFrom[:len(followedFrom):len(followedFrom)], realSymlinkDir)
+	for _, dir := range followedFrom {
+		if isPathInside(dir, realTargetPath) {
+			return nil, nil, fmt.Errorf("symlink %q to %q creates a loop", src, realTargetPath)
+		}
+	}
+
+	return targetFileInfo, followedFrom, nil
+}
+
+// Decides whether a named pipe, a device or a socket should be recreated in destination.
+func (c *CopyRecurse) processSpecialFile(ctx context.Context, src string, srcFileInfo os.FileInfo, dest string) (bool, error) {
+	logboek.Context(ctx).Debug().LogF("Processing special file %q of a type %q.\n", src, srcFileInfo.Mode().Type().String())
+
+	var action SpecialFileAction
+	switch {
+	case srcFileInfo.Mode()&os.ModeSocket != 0:
+		if c.onSocket != nil {
+			if err := c.onSocket(src, dest); err != nil {
+				return false, fmt.Errorf("error processing socket %q: %w", src, err)
+			}
+			c.updateResult(func(result *Result) { result.Skipped++ })
+			return false, nil
+		}
+		action = SpecialFileSkip
+	case srcFileInfo.Mode()&os.ModeNamedPipe != 0:
+		action = c.fifoAction
+	case srcFileInfo.Mode()&os.ModeCharDevice != 0:
+		action = c.charDeviceAction
+	case srcFileInfo.Mode()&os.ModeDevice != 0:
+		action = c.blockDeviceAction
+	}
+
+	switch action {
+	case SpecialFileSkip:
+		logboek.Context(ctx).Warn().LogF("File %q is of a type %q. Copying of such a type is not enabled, skipping.\n", src, srcFileInfo.Mode().Type().String())
+		c.updateResult(func(result *Result) { result.Skipped++ })
+		return false, nil
+	case SpecialFileRecreate:
+		return true, nil
+	case SpecialFileFail:
+		return false, fmt.Errorf("copying of file %q of a type %q is forbidden", src, srcFileInfo.Mode().Type().String())
+	default:
+		panic(fmt.Sprintf("unexpected special file action (int %d)", action))
+	}
+}
+
+func (c *CopyRecurse) copySpecialFile(ctx context.Context, src string, srcFileInfo os.FileInfo, dest string) error {
+	logboek.Context(ctx).Debug().LogF("Going to recreate special file %q at %q with UID/GID %v/%v.\n", src, dest, uint32PtrPString(c.uid), uint32PtrPString(c.gid))
+
+	srcStat := getFileStat(srcFileInfo)
+
+	logboek.Context(ctx).Debug().LogF("Removing path %q.\n", dest)
+	if err := c.removeAll(dest); err != nil {
+		return fmt.Errorf("error removing path %q: %w", dest, err)
+	}
+
+	logboek.Context(ctx).Debug().LogF("Creating special file %q of a type %q.\n", dest, srcFileInfo.Mode().Type().String())
+	if err := c.mknod(src, dest, srcFileInfo.Mode().Type()|srcFileInfo.Mode().Perm(), uint64(srcStat.Rdev)); err != nil {
+		return fmt.Errorf("error creating special file %q: %w", dest, err)
+	}
+
+	uid, gid := getNewUIDAndGID(c.uid, c.gid, srcStat)
+
+	logboek.Context(ctx).Debug().LogF("Changing special file %q ownership to %d/%d.\n", dest, uid, gid)
+	if err := c.lchown(dest, uid, gid); err != nil {
+		return fmt.Errorf("error changing ownership for %q: %w", dest, err)
+	}
+
+	// Mknod applies umask and chown can clear setuid/setgid bits, so setting mode after.
+	mode := getModeBits(srcFileInfo.Mode())
+	logboek.Context(ctx).Debug().LogF("Chmod special file %q to %s.\n", dest, mode)
+	if err := c.chmod(dest, mode); err != nil {
+		return fmt.Errorf("error changing mode for %q to %s: %w", dest, mode, err)
+	}
+
+	if c.copyXattrs && !c.planning {
+		if err := c.processXattrs(ctx, src, dest); err != nil {
+			return fmt.Errorf("error processing special file extended attributes: %w", err)
+		}
+	}
+
+	if c.preserveTimes && !c.planning {
+		if err := c.setTimes(ctx, dest, getAtime(srcFileInfo), srcFileInfo.ModTime()); err != nil {
+			return fmt.Errorf("error setting special file times: %w", err)
+		}
+	}
+
+	c.updateResult(func(result *Result) { result.SpecialFiles++ })
+
+	return nil
+}
+
+func (c *CopyRecurse) processFileOwnership(ctx context.Context, srcStat *syscall.Stat_t, destPath string, destFile DestFile) error {
+	logboek.Context(ctx).Debug().LogF("Processing file %q ownership.\n", destPath)
+
+	uid, gid := getNewUIDAndGID(c.uid, c.gid, srcStat)
+
+	logboek.Context(ctx).Debug().LogF("Changing file %q ownership to %d/%d.\n", destPath, uid, gid)
+
+	var err error
+	if osFile, ok := destFile.(*os.File); ok {
+		err = osFile.Chown(uid, gid)
+	} else {
+		err = c.lchown(destPath, uid, gid)
+	}
+	if err != nil {
+		return fmt.Errorf("error changing ownership for %q: %w", destPath, err)
+	}
+
+	return nil
+}
+
+func (c *CopyRecurse) processDirOwnership(ctx context.Context, path string, srcStat *syscall.Stat_t) error {
+	logboek.Context(ctx).Debug().LogF("Processing dir %q ownership.\n", path)
+
+	uid, gid := getNewUIDAndGID(c.uid, c.gid, srcStat)
+
+	logboek.Context(ctx).Debug().LogF("Changing dir %q ownership to %d/%d.\n", path, uid, gid)
+	if err := c.lchown(path, uid, gid); err != nil {
+		return fmt.Errorf("error changing ownership for %q: %w", path, err)
+	}
+
+	return nil
+}
+
+func (c *CopyRecurse) processXattrs(ctx context.Context, src, dest string) error {
+	logboek.Context(ctx).Debug().LogF("Processing extended attributes of %q.\n", dest)
+
+	if c.srcFS != nil {
+		logboek.Context(ctx).Debug().LogF("Extended attributes not supported for fs.FS source %q.\n", src)
+		return nil
+	}
+
+	names, err := listXattrs(src)
+	if isXattrNotSupportedErr(err) {
+		logboek.Context(ctx).Debug().LogF("Extended attributes not supported for %q: %s.\n", src, err)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error listing extended attributes of %q: %w", src, err)
+	}
+
+	for _, name := range names {
+		if !c.matchXattr(name) {
+			logboek.Context(ctx).Debug().LogF("Skipping extended attribute %q of %q.\n", name, src)
+			continue
+		}
+
+		value, err := getXattr(src, name)
+		if errors.Is(err, errXattrNotFound) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("error getting extended attribute %q of %q: %w", name, src, err)
+		}
+
+		logboek.Context(ctx).Debug().LogF("Setting extended attribute %q of %q.\n", name, dest)
+		if err := c.setDestXattr(dest, name, value); isXattrNotSupportedErr(err) || errors.Is(err, errDestNotSupported) {
+			if c.onXattrError != nil {
+				c.onXattrError(dest, name, err)
+			} else {
+				logboek.Context(ctx).Warn().LogF("Extended attribute %q can't be set for %q, skipping: %s.\n", name, dest, err)
+			}
+		} else if err != nil {
+			return fmt.Errorf("error setting extended attribute %q of %q: %w", name, dest, err)
+		}
+	}
+
+	return nil
+}
+
+func (c *CopyRecurse) matchXattr(name string) bool {
+	for _, pattern := range c.xattrExcludes {
+		if matched, _ := path.Match(pattern, name); matched {
+			return false
+		}
+	}
+
+	if len(c.xattrIncludes) == 0 {
+		return true
+	}
+
+	for _, pattern := range c.xattrIncludes {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Creates destination entry with a temporary name and renames it over dest.
+func (c *CopyRecurse) replaceAtomically(ctx context.Context, dest string, create func(tmpPath string) error) error {
+	tmpPath, err := createTempDestEntry(dest, create)
 	if err != nil {
-		return fmt.Errorf("error opening file %q: %w", src, err)
+		return fmt.Errorf("error creating temporary entry for %q: %w", dest, err)
 	}
-	defer srcFile.Close()
 
-	_, err = os.Lstat(dest)
-	if err == nil {
+	if err := c.renameTempDestEntry(ctx, tmpPath, dest); err != nil {
+		c.removeDestAll(tmpPath)
+		return fmt.Errorf("error replacing %q with temporary entry: %w", dest, err)
+	}
+
+	return nil
+}
+
+// Directory in place of dest can't be replaced with rename, so it is removed first.
+func (c *CopyRecurse) renameTempDestEntry(ctx context.Context, tmpPath, dest string) error {
+	destFileInfo, err := c.lstatDest(dest)
+	if err == nil && destFileInfo.IsDir() {
 		logboek.Context(ctx).Debug().LogF("Removing path %q.\n", dest)
-		if err := os.RemoveAll(dest); err != nil {
+		if err := c.removeAll(dest); err != nil {
 			return fmt.Errorf("error removing path %q: %w", dest, err)
 		}
+	} else if err == nil {
+		c.updateResult(func(result *Result) { result.Replaced++ })
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error getting file info for %q: %w", dest, err)
 	}
 
-	logboek.Context(ctx).Debug().LogF("Creating destination file %q.\n", dest)
-	destFile, err := os.Create(dest)
-	if err != nil {
-		return fmt.Errorf("error creating file %q: %w", dest, err)
+	logboek.Context(ctx).Debug().LogF("Renaming %q to %q.\n", tmpPath, dest)
+	if err := c.renameDest(tmpPath, dest); err != nil {
+		return fmt.Errorf("error renaming %q to %q: %w", tmpPath, dest, err)
 	}
-	defer destFile.Close()
 
-	logboek.Context(ctx).Debug().LogF("Chmod destination file %q to %s.\n", dest, srcFileInfo.Mode().Perm())
-	if err := destFile.Chmod(srcFileInfo.Mode().Perm()); err != nil {
-		return fmt.Errorf("error changing permissions for file %q to %s: %w", dest, srcFileInfo.Mode().Perm(), err)
+	return nil
+}
+
+// Limits of file name length on most file systems.
+const maxNameLen = 255
+
+// Calls create with unused temporary paths in the directory of dest until it doesn't fail because of existing path.
+func createTempDestEntry(dest string, create func(tmpPath string) error) (string, error) {
+	// Leave room for the dots, the random number and the suffix, so long names don't become too long.
+	base := filepath.Base(dest)
+	if maxBaseLen := maxNameLen - len(".."+".tmp") - len(fmt.Sprint(uint32(math.MaxUint32))); len(base) > maxBaseLen {
+		// Don't cut a multibyte character.
+		for maxBaseLen > 0 && !utf8.RuneStart(base[maxBaseLen]) {
+			maxBaseLen--
+		}
+		base = base[:maxBaseLen]
 	}
 
-	if err := c.processFileOwnership(ctx, srcStat, destFile); err != nil {
-		return fmt.Errorf("error processing file ownership: %w", err)
+	for i := 0; i < 10000; i++ {
+		tmpPath := filepath.Join(filepath.Dir(dest), fmt.Sprintf(".%s.%d.tmp", base, rand.Uint32()))
+		if err := create(tmpPath); errors.Is(err, os.ErrExist) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		return tmpPath, nil
 	}
 
-	logboek.Context(ctx).Debug().LogF("Copying file contents from %q to %q.\n", src, dest)
-	if _, err := io.Copy(destFile, srcFile); err != nil {
-		return fmt.Errorf("error copying file from %q to %q: %w", src, dest, err)
+	return "", fmt.Errorf("can't find unused temporary path for %q", dest)
+}
+
+// Sets directory modes and times that could be set only after all directory entries written.
+func (c *CopyRecurse) processPendingDestDirs(ctx context.Context) error {
+	for i := len(c.pendingDestDirs) - 1; i >= 0; i-- {
+		pendingDir := c.pendingDestDirs[i]
+
+		if pendingDir.setMode {
+			logboek.Context(ctx).Debug().LogF("Setting mode of dir %q to %s.\n", pendingDir.path, pendingDir.mode)
+			if err := c.chmod(pendingDir.path, pendingDir.mode); err != nil {
+				return fmt.Errorf("error changing mode for %q to %s: %w", pendingDir.path, pendingDir.mode, err)
+			}
+		}
+
+		if pendingDir.setTimes {
+			if err := c.setTimes(ctx, pendingDir.path, pendingDir.atime, pendingDir.mtime); err != nil {
+				return fmt.Errorf("error setting dir times: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *CopyRecurse) planFileCopy(ctx context.Context, src string, srcFileInfo os.FileInfo, srcStat *syscall.Stat_t, dest string) error {
+	if err := c.removeAll(dest); err != nil {
+		return fmt.Errorf("error removing path %q: %w", dest, err)
 	}
 
+	perm := srcFileInfo.Mode().Perm()
+	c.addPlanAction(PlanAction{Type: PlanActionCreateFile, Path: dest, Src: src, Mode: &perm})
+
+	uid, gid := getNewUIDAndGID(c.uid, c.gid, srcStat)
+	c.addPlanAction(PlanAction{Type: PlanActionChown, Path: dest, UID: &uid, GID: &gid})
+
+	mode := getModeBits(srcFileInfo.Mode())
+	c.addPlanAction(PlanAction{Type: PlanActionChmod, Path: dest, Mode: &mode})
+
 	return nil
 }
 
-func (c *CopyRecurse) copySymlink(ctx context.Context, src string, dest string) error {
-	logboek.Context(ctx).Debug().LogF("Going to copy symlink %q to %q as is with UID/GID %v/%v.\n", src, dest, uint32PtrPString(c.uid), uint32PtrPString(c.gid))
+func (c *CopyRecurse) addPlanAction(action PlanAction) {
+	c.planActions = append(c.planActions, action)
+}
+
+// Destination in the local file system.
+type osDest struct{}
+
+func (osDest) Lstat(path string) (fs.FileInfo, error) {
+	return os.Lstat(path)
+}
+
+func (osDest) Mkdir(path string, perm fs.FileMode) error {
+	return os.Mkdir(path, perm)
+}
 
-	linkDestination, err := os.Readlink(src)
+func (osDest) OpenFile(path string, flag int, perm fs.FileMode) (DestFile, error) {
+	file, err := os.OpenFile(path, flag, perm)
 	if err != nil {
-		return fmt.Errorf("error reading symlink %q: %w", src, err)
+		return nil, err
 	}
 
-	logboek.Context(ctx).Debug().LogF("Removing path %q.\n", dest)
-	if err := os.RemoveAll(dest); err != nil {
-		return fmt.Errorf("error removing path %q: %w", dest, err)
+	return file, nil
+}
+
+func (osDest) Symlink(target, path string) error {
+	return os.Symlink(target, path)
+}
+
+func (osDest) Lchown(path string, uid, gid int) error {
+	return os.Lchown(path, uid, gid)
+}
+
+func (osDest) Chmod(path string, mode fs.FileMode) error {
+	return os.Chmod(path, mode)
+}
+
+func (osDest) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (osDest) ReadDir(path string) ([]fs.DirEntry, error) {
+	return os.ReadDir(path)
+}
+
+func (osDest) Readlink(path string) (string, error) {
+	return os.Readlink(path)
+}
+
+func (osDest) Rename(oldPath, newPath string) error {
+	return os.Rename(oldPath, newPath)
+}
+
+func (osDest) Link(target, path string) error {
+	return os.Link(target, path)
+}
+
+func (osDest) Mknod(path string, mode fs.FileMode, dev uint64) error {
+	return mknod(path, getUnixFileType(mode)|uint32(mode.Perm()), dev)
+}
+
+func (osDest) Lchtimes(path string, atime, mtime time.Time) error {
+	times := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, times, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+func (osDest) Lsetxattr(path, name string, value []byte) error {
+	return setXattr(path, name, value)
+}
+
+func (osDest) exchange(path1, path2 string) error {
+	return exchangePaths(path1, path2)
+}
+
+// While planning, paths below directories that would be created don't exist yet.
+func (c *CopyRecurse) lstatDest(path string) (os.FileInfo, error) {
+	if c.planning {
+		for dir := getParentDir(path); ; dir = getParentDir(dir) {
+			if _, ok := c.plannedDirs[dir]; ok {
+				return nil, &fs.PathError{Op: "lstat", Path: path, Err: fs.ErrNotExist}
+			}
+
+			if dir == getParentDir(dir) {
+				break
+			}
+		}
+	}
+
+	return c.destFS.Lstat(path)
+}
+
+// Follows symlinks only in the local file system.
+func (c *CopyRecurse) statDest(path string) (os.FileInfo, error) {
+	if _, ok := c.destFS.(osDest); ok {
+		return os.Stat(path)
+	}
+
+	return c.destFS.Lstat(path)
+}
+
+func (c *CopyRecurse) mkdir(path string, perm os.FileMode) error {
+	if c.planning {
+		c.addPlanAction(PlanAction{Type: PlanActionMkdir, Path: path, Mode: &perm})
+		c.plannedDirs[path] = struct{}{}
+		return nil
+	}
+
+	return c.destFS.Mkdir(path, perm)
+}
+
+func (c *CopyRecurse) mkdirAll(path string, perm os.FileMode) error {
+	var missingDirs []string
+	for dir := filepath.Clean(path); ; dir = getParentDir(dir) {
+		if _, err := c.lstatDest(dir); err == nil {
+			break
+		} else if !errors.Is(err, os.ErrNotExist) && !errors.Is(err, syscall.ENOTDIR) {
+			return err
+		}
+
+		missingDirs = append(missingDirs, dir)
+		if dir == getParentDir(dir) {
+			break
+		}
 	}
 
-	logboek.Context(ctx).Debug().LogF("Creating symlink from %q to %q.\n", dest, linkDestination)
-	if err := os.Symlink(linkDestination, dest); err != nil {
-		return fmt.Errorf("error creating symlink %q: %w", dest, err)
+	for i := len(missingDirs) - 1; i >= 0; i-- {
+		if err := c.mkdir(missingDirs[i], perm); err != nil && !errors.Is(err, os.ErrExist) {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (c *CopyRecurse) processFileOwnership(ctx context.Context, srcStat *syscall.Stat_t, destFile *os.File) error {
-	logboek.Context(ctx).Debug().LogF("Processing file %q ownership.\n", destFile.Name())
+// Removes existing destination entry, if any.
+func (c *CopyRecurse) removeAll(path string) error {
+	fileInfo, err := c.lstatDest(path)
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if c.planning {
+		if fileInfo.IsDir() {
+			c.addPlanAction(PlanAction{Type: PlanActionRemoveAll, Path: path})
+		} else {
+			c.addPlanAction(PlanAction{Type: PlanActionReplace, Path: path})
+		}
+	} else if err := c.removeDestAll(path); err != nil {
+		return err
+	}
+
+	c.updateResult(func(result *Result) { result.Replaced++ })
 
-	uid, gid := getNewUIDAndGID(c.uid, c.gid, srcStat)
+	return nil
+}
+
+func (c *CopyRecurse) chmod(path string, mode os.FileMode) error {
+	if c.planning {
+		c.addPlanAction(PlanAction{Type: PlanActionChmod, Path: path, Mode: &mode})
+		return nil
+	}
+
+	return c.destFS.Chmod(path, mode)
+}
+
+func (c *CopyRecurse) lchown(path string, uid, gid int) error {
+	if c.planning {
+		c.addPlanAction(PlanAction{Type: PlanActionChown, Path: path, UID: &uid, GID: &gid})
+		return nil
+	}
+
+	return c.destFS.Lchown(path, uid, gid)
+}
+
+func (c *CopyRecurse) link(target, path string) error {
+	if c.planning {
+		c.addPlanAction(PlanAction{Type: PlanActionLink, Path: path, Target: target})
+		return nil
+	}
+
+	linkDest, ok := c.destFS.(LinkDest)
+	if !ok {
+		return fmt.Errorf("hard linking %w", errDestNotSupported)
+	}
+
+	return linkDest.Link(target, path)
+}
+
+func (c *CopyRecurse) symlink(target, path string) error {
+	if c.planning {
+		c.addPlanAction(PlanAction{Type: PlanActionCreateSymlink, Path: path, Target: target})
+		return nil
+	}
+
+	return c.destFS.Symlink(target, path)
+}
+
+// Mode has a type of special file along with permission bits.
+func (c *CopyRecurse) mknod(src, path string, mode os.FileMode, dev uint64) error {
+	if c.planning {
+		perm := mode.Perm()
+		c.addPlanAction(PlanAction{Type: PlanActionMknod, Path: path, Src: src, Mode: &perm})
+		return nil
+	}
+
+	mknodDest, ok := c.destFS.(MknodDest)
+	if !ok {
+		return fmt.Errorf("creating special files %w", errDestNotSupported)
+	}
+
+	return mknodDest.Mknod(path, mode, dev)
+}
+
+// The same as fs.ReadLinkFS of newer Go versions.
+type readLinkFS interface {
+	fs.FS
+	ReadLink(name string) (string, error)
+	Lstat(name string) (fs.FileInfo, error)
+}
+
+func (c *CopyRecurse) lstatSrc(path string) (os.FileInfo, error) {
+	if srcFS, ok := c.srcFS.(readLinkFS); ok {
+		return srcFS.Lstat(path)
+	} else if c.srcFS != nil {
+		return fs.Stat(c.srcFS, path)
+	}
+
+	return os.Lstat(path)
+}
+
+func (c *CopyRecurse) statSrc(path string) (os.FileInfo, error) {
+	if c.srcFS == nil {
+		return os.Stat(path)
+	}
+
+	name := path
+	for resolvedSymlinks := 0; ; resolvedSymlinks++ {
+		fileInfo, err := c.lstatSrc(name)
+		if err != nil || fileInfo.Mode()&os.ModeSymlink == 0 {
+			return fileInfo, err
+		} else if resolvedSymlinks == maxResolvedSymlinks {
+			return nil, &fs.PathError{Op: "stat", Path: path, Err: syscall.ELOOP}
+		}
+
+		linkDestination, err := c.readSrcLink(name)
+		if err != nil {
+			return nil, err
+		}
+
+		// Absolute symlinks and symlinks pointing above the root of fs.FS are dangling.
+		name = filepath.Join(getParentDir(name), linkDestination)
+		if filepath.IsAbs(linkDestination) || !fs.ValidPath(name) {
+			return nil, &fs.PathError{Op: "stat", Path: path, Err: fs.ErrNotExist}
+		}
+	}
+}
+
+// Symlink destination of fs.FS source without ReadLink method read as file contents, as zip archives store it.
+func (c *CopyRecurse) readSrcLink(path string) (string, error) {
+	if srcFS, ok := c.srcFS.(readLinkFS); ok {
+		return srcFS.ReadLink(path)
+	} else if c.srcFS != nil {
+		linkDestination, err := fs.ReadFile(c.srcFS, path)
+		return string(linkDestination), err
+	}
 
-	logboek.Context(ctx).Debug().LogF("Changing file %q ownership to %d/%d.\n", destFile.Name(), uid, gid)
-	if err := destFile.Chown(uid, gid); err != nil {
-		return fmt.Errorf("error changing ownership for %q: %w", destFile.Name(), err)
+	return os.Readlink(path)
+}
+
+func (c *CopyRecurse) openSrc(path string) (fs.File, error) {
+	if c.srcFS != nil {
+		return c.srcFS.Open(path)
+	}
+
+	return os.Open(path)
+}
+
+func (c *CopyRecurse) subSrcFS(path string) (fs.FS, error) {
+	if c.srcFS != nil {
+		return fs.Sub(c.srcFS, path)
+	}
+
+	return os.DirFS(path), nil
+}
+
+func (c *CopyRecurse) openDestFile(path string, flag int, perm os.FileMode) (DestFile, error) {
+	return c.destFS.OpenFile(path, flag, perm)
+}
+
+func (c *CopyRecurse) readDestDir(path string) ([]fs.DirEntry, error) {
+	readDirDest, ok := c.destFS.(ReadDirDest)
+	if !ok {
+		return nil, fmt.Errorf("reading directories %w", errDestNotSupported)
+	}
+
+	return readDirDest.ReadDir(path)
+}
+
+func (c *CopyRecurse) readDestLink(path string) (string, error) {
+	readLinkDest, ok := c.destFS.(ReadLinkDest)
+	if !ok {
+		return "", fmt.Errorf("reading symlinks %w", errDestNotSupported)
+	}
+
+	return readLinkDest.Readlink(path)
+}
+
+func (c *CopyRecurse) renameDest(oldPath, newPath string) error {
+	renameDest, ok := c.destFS.(RenameDest)
+	if !ok {
+		return fmt.Errorf("renaming %w", errDestNotSupported)
+	}
+
+	return renameDest.Rename(oldPath, newPath)
+}
+
+func (c *CopyRecurse) exchangeDest(path1, path2 string) error {
+	exchangeDest, ok := c.destFS.(interface {
+		exchange(path1, path2 string) error
+	})
+	if !ok {
+		return errExchangeNotSupported
+	}
+
+	return exchangeDest.exchange(path1, path2)
+}
+
+func (c *CopyRecurse) removeDestAll(path string) error {
+	return c.destFS.RemoveAll(path)
+}
+
+func (c *CopyRecurse) setDestXattr(path, name string, value []byte) error {
+	xattrDest, ok := c.destFS.(XattrDest)
+	if !ok {
+		return fmt.Errorf("setting extended attributes %w", errDestNotSupported)
+	}
+
+	return xattrDest.Lsetxattr(path, name, value)
+}
+
+// Sets times through descriptor of the opened file if it has one, otherwise by path.
+func (c *CopyRecurse) setFileTimes(ctx context.Context, path string, file DestFile, atime, mtime time.Time) error {
+	osFile, ok := file.(*os.File)
+	if !ok {
+		return c.setTimes(ctx, path, atime, mtime)
+	}
+
+	logboek.Context(ctx).Debug().LogF("Setting times of %q to atime %s and mtime %s.\n", path, atime, mtime)
+	if err := futimens(osFile, atime, mtime); err != nil {
+		return fmt.Errorf("error setting times of %q: %w", path, err)
 	}
 
 	return nil
 }
 
-func (c *CopyRecurse) processDirOwnership(ctx context.Context, path string, srcStat *syscall.Stat_t) error {
-	logboek.Context(ctx).Debug().LogF("Processing dir %q ownership.\n", path)
+func (c *CopyRecurse) setTimes(ctx context.Context, path string, atime, mtime time.Time) error {
+	logboek.Context(ctx).Debug().LogF("Setting times of %q to atime %s and mtime %s.\n", path, atime, mtime)
 
-	uid, gid := getNewUIDAndGID(c.uid, c.gid, srcStat)
+	chtimesDest, ok := c.destFS.(ChtimesDest)
+	if !ok {
+		return fmt.Errorf("setting times %w", errDestNotSupported)
+	}
 
-	logboek.Context(ctx).Debug().LogF("Changing dir %q ownership to %d/%d.\n", path, uid, gid)
-	if err := os.Lchown(path, uid, gid); err != nil {
-		return fmt.Errorf("error changing ownership for %q: %w", path, err)
+	if err := chtimesDest.Lchtimes(path, atime, mtime); err != nil {
+		return fmt.Errorf("error setting times of %q: %w", path, err)
 	}
 
 	return nil
 }
 
-func walkPath(ctx context.Context, path string, fn func(entryRelPath string, dirEntry *fs.DirEntry, err error) error) error {
-	fileInfo, err := os.Lstat(path)
+// If follow is true, then path walked as a directory if it is a symlink to a directory.
+func (c *CopyRecurse) walkPath(ctx context.Context, path string, follow bool, fn func(entryRelPath string, dirEntry *fs.DirEntry, err error) error) error {
+	stat := c.lstatSrc
+	if follow {
+		stat = c.statSrc
+	}
+
+	fileInfo, err := stat(path)
 	if err != nil {
 		return fmt.Errorf("error getting file info for path %q: %w", path, err)
 	}
@@ -493,19 +2434,69 @@ func walkPath(ctx context.Context, path string, fn func(entryRelPath string, dir
 		logboek.Context(ctx).Debug().LogF("Executing walk function for file entry %q.\n", entry.Name())
 		return fn(".", &entry, nil)
 	} else {
-		rootFs := os.DirFS(path)
+		rootFs, err := c.subSrcFS(path)
+		if err != nil {
+			return fmt.Errorf("error getting file system of directory %q: %w", path, err)
+		}
+
 		if err := fs.WalkDir(rootFs, ".", func(relSrc string, entry fs.DirEntry, err error) error {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+
 			logboek.Context(ctx).Debug().LogF("Executing walk function for dir entry %q.\n", entry.Name())
 			return fn(relSrc, &entry, err)
 		}); err != nil {
-			return fmt.Errorf("error walking directory %q: %w", rootFs, err)
+			return fmt.Errorf("error walking directory %q: %w", path, err)
 		}
 		return nil
 	}
 }
 
-func getParentDir(path string) string {
-	return filepath.Dir(filepath.Clean(path))
+// Permission bits along with setuid, setgid and sticky bits.
+func getModeBits(mode os.FileMode) os.FileMode {
+	return mode & (os.ModePerm | specialModeBits)
+}
+
+// File type bits of a special file as expected by mknod syscall.
+func getUnixFileType(mode os.FileMode) uint32 {
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		return unix.S_IFIFO
+	case mode&os.ModeCharDevice != 0:
+		return unix.S_IFCHR
+	default:
+		return unix.S_IFBLK
+	}
+}
+
+// Mode bits as expected by chmod syscall.
+func getUnixModeBits(mode os.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= unix.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= unix.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= unix.S_ISVTX
+	}
+
+	return bits
+}
+
+// Source files of fs.FS might have no syscall.Stat_t, then ownership of the current user used and hard links not
+// detected.
+func getFileStat(fileInfo os.FileInfo) *syscall.Stat_t {
+	switch sys := fileInfo.Sys().(type) {
+	case *syscall.Stat_t:
+		return sys
+	case *MemEntry:
+		return &syscall.Stat_t{Uid: uint32(sys.UID), Gid: uint32(sys.GID), Nlink: 1}
+	}
+
+	return &syscall.Stat_t{Uid: uint32(os.Geteuid()), Gid: uint32(os.Getegid()), Nlink: 1}
 }
 
 func getNewUIDAndGID(newDestUid, newDestGid *uint32, srcStat *syscall.Stat_t) (int, int) {
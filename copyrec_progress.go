@@ -0,0 +1,54 @@
+package copyrec
+
+import (
+	"sync"
+	"time"
+)
+
+// Calls the Progress callback with accumulated counters, not more often than once per interval.
+type progressReporter struct {
+	fn       func(progress Progress)
+	interval time.Duration
+
+	mu         sync.Mutex
+	progress   Progress
+	lastReport time.Time
+}
+
+func newProgressReporter(fn func(progress Progress), interval time.Duration) *progressReporter {
+	return &progressReporter{
+		fn:       fn,
+		interval: interval,
+	}
+}
+
+// Updates counters and reports them if the interval passed since the last report. Safe to call on nil reporter.
+func (r *progressReporter) update(path string, fn func(progress *Progress)) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fn(&r.progress)
+	r.progress.CurrentPath = path
+
+	if now := time.Now(); now.Sub(r.lastReport) >= r.interval {
+		r.lastReport = now
+		r.fn(r.progress)
+	}
+}
+
+// Reports counters regardless of the interval.
+func (r *progressReporter) report() {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lastReport = time.Now()
+	r.fn(r.progress)
+}
@@ -1,15 +1,31 @@
 package copyrec_test
 
 import (
+	"archive/zip"
+	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io/fs"
+	"net"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
+	"testing/fstest"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"golang.org/x/sys/unix"
 
 	copyrec "github.com/werf/copy-recurse"
+	"github.com/werf/logboek"
 )
 
 type (
@@ -28,9 +44,22 @@ type CopyRecurseTestConfig struct {
 var _ = Describe("CopyRecurse", func() {
 	var tmpRoot, tmpSrc, tmpDest string
 	var ctx context.Context
+	var usedCopyMethods map[string]copyrec.CopyMethod
+
+	var reportedProgress []copyrec.Progress
+
+	recordCopyMethod := func(src, dest string, method copyrec.CopyMethod) {
+		usedCopyMethods[dest] = method
+	}
+
+	recordProgress := func(progress copyrec.Progress) {
+		reportedProgress = append(reportedProgress, progress)
+	}
 
 	BeforeEach(func() {
 		ctx = context.Background()
+		usedCopyMethods = map[string]copyrec.CopyMethod{}
+		reportedProgress = nil
 
 		var err error
 		tmpRoot, err = os.MkdirTemp("", "*-copyrec-test")
@@ -85,6 +114,96 @@ var _ = Describe("CopyRecurse", func() {
 				},
 			},
 		),
+		Entry("copy file data with reflink or fall back to userspace copy",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					CopyMethods:      []copyrec.CopyMethod{copyrec.CopyMethodReflink, copyrec.CopyMethodUserspace},
+					OnFileDataCopied: recordCopyMethod,
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					Expect(os.WriteFile(filepath.Join(tmpSrc, "file"), []byte("content"), 0o644)).To(Succeed())
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					Expect(getFileContent(filepath.Join(tmpDest, "file"))).To(Equal("content"))
+					Expect(usedCopyMethods).To(HaveKeyWithValue(filepath.Join(tmpDest, "file"), BeElementOf(copyrec.CopyMethodReflink, copyrec.CopyMethodUserspace)))
+				},
+			},
+		),
+		Entry("copy file data with copy_file_range only",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					CopyMethods:      []copyrec.CopyMethod{copyrec.CopyMethodCopyFileRange},
+					OnFileDataCopied: recordCopyMethod,
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					Expect(os.WriteFile(filepath.Join(tmpSrc, "file"), []byte("content"), 0o644)).To(Succeed())
+					touchFile(filepath.Join(tmpSrc, "emptyfile"))
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					Expect(getFileContent(filepath.Join(tmpDest, "file"))).To(Equal("content"))
+					Expect(getFileContent(filepath.Join(tmpDest, "emptyfile"))).To(BeEmpty())
+					Expect(usedCopyMethods).To(HaveKeyWithValue(filepath.Join(tmpDest, "file"), copyrec.CopyMethodCopyFileRange))
+				},
+			},
+		),
+		Entry("copy file data with sendfile only",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					CopyMethods:      []copyrec.CopyMethod{copyrec.CopyMethodSendfile},
+					OnFileDataCopied: recordCopyMethod,
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					Expect(os.WriteFile(filepath.Join(tmpSrc, "file"), []byte("content"), 0o644)).To(Succeed())
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					Expect(getFileContent(filepath.Join(tmpDest, "file"))).To(Equal("content"))
+					Expect(usedCopyMethods).To(HaveKeyWithValue(filepath.Join(tmpDest, "file"), copyrec.CopyMethodSendfile))
+				},
+			},
+		),
+		Entry("copy file data in userspace only",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					CopyMethods:      []copyrec.CopyMethod{copyrec.CopyMethodUserspace},
+					OnFileDataCopied: recordCopyMethod,
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					Expect(os.WriteFile(filepath.Join(tmpSrc, "file"), []byte("content"), 0o644)).To(Succeed())
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					Expect(getFileContent(filepath.Join(tmpDest, "file"))).To(Equal("content"))
+					Expect(usedCopyMethods).To(HaveKeyWithValue(filepath.Join(tmpDest, "file"), copyrec.CopyMethodUserspace))
+				},
+			},
+		),
+		Entry("preserve holes of sparse file copying data with copy_file_range",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					PreserveSparseFiles: true,
+					CopyMethods:         []copyrec.CopyMethod{copyrec.CopyMethodCopyFileRange},
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					createSparseFile(filepath.Join(tmpSrc, "file"))
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					expectSparseFileCopied(filepath.Join(tmpSrc, "file"), filepath.Join(tmpDest, "file"))
+				},
+			},
+		),
+		Entry("preserve holes of sparse file copying data with userspace copy",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					PreserveSparseFiles: true,
+					CopyMethods:         []copyrec.CopyMethod{copyrec.CopyMethodUserspace},
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					createSparseFile(filepath.Join(tmpSrc, "file"))
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					expectSparseFileCopied(filepath.Join(tmpSrc, "file"), filepath.Join(tmpDest, "file"))
+				},
+			},
+		),
 		Entry("copy file nested in a dir to a symlinked destination dir",
 			CopyRecurseTestConfig{
 				SrcRel:             "file1",
@@ -150,6 +269,117 @@ var _ = Describe("CopyRecurse", func() {
 				},
 			},
 		),
+		Entry("copy setuid, setgid and sticky bits of files and directories",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					// User not allowed to set UID to other than his own on *nix.
+					UID: intToUint32Ptr(os.Getuid()),
+					// User not allowed to set GID to other than one of his own groups on *nix.
+					GID: intToUint32Ptr(getFirstUserGroupSortedNumerically()),
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					Expect(os.Mkdir(filepath.Join(tmpSrc, "tmp"), os.ModePerm)).To(Succeed())
+					Expect(os.Chmod(filepath.Join(tmpSrc, "tmp"), 0o777|os.ModeSticky)).To(Succeed())
+					Expect(os.Mkdir(filepath.Join(tmpSrc, "setgid-dir"), os.ModePerm)).To(Succeed())
+					Expect(os.Chmod(filepath.Join(tmpSrc, "setgid-dir"), 0o775|os.ModeSetgid)).To(Succeed())
+					Expect(os.WriteFile(filepath.Join(tmpSrc, "setgid-dir", "setuid-file"), []byte("content"), 0o755)).To(Succeed())
+					Expect(os.Chmod(filepath.Join(tmpSrc, "setgid-dir", "setuid-file"), 0o755|os.ModeSetuid)).To(Succeed())
+					Expect(os.WriteFile(filepath.Join(tmpSrc, "setgid-dir", "setgid-file"), []byte("content"), 0o755)).To(Succeed())
+					Expect(os.Chmod(filepath.Join(tmpSrc, "setgid-dir", "setgid-file"), 0o755|os.ModeSetgid)).To(Succeed())
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					fi, _ := getFileInfoAndStat(filepath.Join(tmpDest, "tmp"))
+					Expect(fi.Mode().String()).To(Equal((0o777 | os.ModeSticky | os.ModeDir).String()))
+
+					fi, _ = getFileInfoAndStat(filepath.Join(tmpDest, "setgid-dir"))
+					Expect(fi.Mode().String()).To(Equal((0o775 | os.ModeSetgid | os.ModeDir).String()))
+
+					fi, _ = getFileInfoAndStat(filepath.Join(tmpDest, "setgid-dir", "setuid-file"))
+					Expect(fi.Mode().String()).To(Equal((0o755 | os.ModeSetuid).String()))
+
+					fi, _ = getFileInfoAndStat(filepath.Join(tmpDest, "setgid-dir", "setgid-file"))
+					Expect(fi.Mode().String()).To(Equal((0o755 | os.ModeSetgid).String()))
+				},
+			},
+		),
+		Entry("copy directories with correct modes regardless of umask",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					DeferCleanup(syscall.Umask, syscall.Umask(0o077))
+
+					Expect(os.MkdirAll(filepath.Join(tmpSrc, "subdir", "subsubdir"), os.ModePerm)).To(Succeed())
+					Expect(os.Chmod(filepath.Join(tmpSrc, "subdir"), 0o775)).To(Succeed())
+					Expect(os.Chmod(filepath.Join(tmpSrc, "subdir", "subsubdir"), 0o757)).To(Succeed())
+					Expect(os.WriteFile(filepath.Join(tmpSrc, "subdir", "subsubdir", "file"), []byte("content"), 0o666)).To(Succeed())
+					Expect(os.Chmod(filepath.Join(tmpSrc, "subdir", "subsubdir", "file"), 0o666)).To(Succeed())
+
+					touchFile(filepath.Join(tmpDest, "subdir"))
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					fi, _ := getFileInfoAndStat(filepath.Join(tmpDest, "subdir"))
+					Expect(fi.Mode().String()).To(Equal(os.FileMode(0o775 | os.ModeDir).String()))
+
+					fi, _ = getFileInfoAndStat(filepath.Join(tmpDest, "subdir", "subsubdir"))
+					Expect(fi.Mode().String()).To(Equal(os.FileMode(0o757 | os.ModeDir).String()))
+
+					fi, _ = getFileInfoAndStat(filepath.Join(tmpDest, "subdir", "subsubdir", "file"))
+					Expect(fi.Mode().String()).To(Equal(os.FileMode(0o666).String()))
+				},
+			},
+		),
+		Entry("copy read-only directories with entries",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					DeferCleanup(makeDirsWritable, tmpRoot)
+
+					Expect(os.MkdirAll(filepath.Join(tmpSrc, "ro", "sub"), os.ModePerm)).To(Succeed())
+					Expect(os.WriteFile(filepath.Join(tmpSrc, "ro", "sub", "file"), []byte("content"), 0o444)).To(Succeed())
+					Expect(os.Chmod(filepath.Join(tmpSrc, "ro", "sub"), 0o500)).To(Succeed())
+					Expect(os.Chmod(filepath.Join(tmpSrc, "ro"), 0o555)).To(Succeed())
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					fi, _ := getFileInfoAndStat(filepath.Join(tmpDest, "ro"))
+					Expect(fi.Mode().String()).To(Equal(os.FileMode(0o555 | os.ModeDir).String()))
+
+					fi, _ = getFileInfoAndStat(filepath.Join(tmpDest, "ro", "sub"))
+					Expect(fi.Mode().String()).To(Equal(os.FileMode(0o500 | os.ModeDir).String()))
+
+					fi, _ = getFileInfoAndStat(filepath.Join(tmpDest, "ro", "sub", "file"))
+					Expect(fi.Mode().String()).To(Equal(os.FileMode(0o444).String()))
+					Expect(getFileContent(filepath.Join(tmpDest, "ro", "sub", "file"))).To(Equal("content"))
+				},
+			},
+		),
+		Entry("copy read-only directories with entries matching only files",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					MatchFile: func(path string) (bool, error) {
+						return filepath.Base(path) == "file", nil
+					},
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					DeferCleanup(makeDirsWritable, tmpRoot)
+
+					Expect(os.MkdirAll(filepath.Join(tmpSrc, "ro", "sub"), os.ModePerm)).To(Succeed())
+					Expect(os.WriteFile(filepath.Join(tmpSrc, "ro", "sub", "file"), []byte("content"), 0o444)).To(Succeed())
+					Expect(os.Chmod(filepath.Join(tmpSrc, "ro", "sub"), 0o500)).To(Succeed())
+					Expect(os.Chmod(filepath.Join(tmpSrc, "ro"), 0o555)).To(Succeed())
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					fi, _ := getFileInfoAndStat(filepath.Join(tmpDest, "ro"))
+					Expect(fi.Mode().String()).To(Equal(os.FileMode(0o555 | os.ModeDir).String()))
+
+					fi, _ = getFileInfoAndStat(filepath.Join(tmpDest, "ro", "sub"))
+					Expect(fi.Mode().String()).To(Equal(os.FileMode(0o500 | os.ModeDir).String()))
+
+					fi, _ = getFileInfoAndStat(filepath.Join(tmpDest, "ro", "sub", "file"))
+					Expect(fi.Mode().String()).To(Equal(os.FileMode(0o444).String()))
+					Expect(getFileContent(filepath.Join(tmpDest, "ro", "sub", "file"))).To(Equal("content"))
+				},
+			},
+		),
 		Entry("copy nothing when nothing is in source dir",
 			CopyRecurseTestConfig{
 				CopyRecurseOptions: copyrec.Options{},
@@ -165,13 +395,63 @@ var _ = Describe("CopyRecurse", func() {
 			CopyRecurseTestConfig{
 				CopyRecurseOptions: copyrec.Options{},
 				CreateFilesFunc: func(config CopyRecurseTestConfig) {
-					Expect(syscall.Mkfifo(filepath.Join(tmpSrc, "file"), uint32(os.ModePerm))).To(Succeed())
+					Expect(unix.Mkfifo(filepath.Join(tmpSrc, "file"), uint32(os.ModePerm))).To(Succeed())
 				},
 				ExpectedFunc: func(config CopyRecurseTestConfig) {
 					Expect(filepath.Join(tmpDest, "file")).ToNot(BeAnExistingFile())
 				},
 			},
 		),
+		Entry("recreate FIFO nested in a dir",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					FIFOAction: copyrec.SpecialFileRecreate,
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					Expect(os.Mkdir(filepath.Join(tmpSrc, "subdir"), os.ModePerm)).To(Succeed())
+					Expect(unix.Mkfifo(filepath.Join(tmpSrc, "subdir", "fifo"), 0o640)).To(Succeed())
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					fi, _ := getFileInfoAndStat(filepath.Join(tmpDest, "subdir", "fifo"))
+					Expect(fi.Mode().String()).To(Equal((0o640 | os.ModeNamedPipe).String()))
+				},
+			},
+		),
+		Entry("recreate character device",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					CharDeviceAction: copyrec.SpecialFileRecreate,
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					mknodOrSkip(filepath.Join(tmpSrc, "null"), unix.S_IFCHR|0o666, unix.Mkdev(1, 3))
+					Expect(os.Chmod(filepath.Join(tmpSrc, "null"), 0o666)).To(Succeed())
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					fi, stat := getFileInfoAndStat(filepath.Join(tmpDest, "null"))
+					Expect(fi.Mode().String()).To(Equal((0o666 | os.ModeDevice | os.ModeCharDevice).String()))
+					Expect(stat.Rdev).To(Equal(unix.Mkdev(1, 3)))
+				},
+			},
+		),
+		Entry("pass socket to callback",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					OnSocket: func(src, dest string) error {
+						touchFile(dest + ".socket")
+						return nil
+					},
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					listener, err := net.Listen("unix", filepath.Join(tmpSrc, "socket"))
+					Expect(err).ToNot(HaveOccurred())
+					DeferCleanup(listener.Close)
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					Expect(filepath.Join(tmpDest, "socket")).ToNot(BeAnExistingFile())
+					Expect(filepath.Join(tmpDest, "socket.socket")).To(BeAnExistingFile())
+				},
+			},
+		),
 		Entry("copy nested directories with file",
 			CopyRecurseTestConfig{
 				CopyRecurseOptions: copyrec.Options{},
@@ -276,98 +556,470 @@ var _ = Describe("CopyRecurse", func() {
 				},
 			},
 		),
-		Entry("merge directories",
+		Entry("preserve hard links between files matched differently",
 			CopyRecurseTestConfig{
-				CopyRecurseOptions: copyrec.Options{},
+				CopyRecurseOptions: copyrec.Options{
+					PreserveHardLinks: true,
+					MatchDir: func(path string) (copyrec.DirAction, error) {
+						if filepath.Base(path) == "matched-subdir" {
+							return copyrec.DirMatch, nil
+						}
+						return copyrec.DirFallThrough, nil
+					},
+					MatchFile: func(path string) (bool, error) {
+						return filepath.Base(path) != "unmatched-file", nil
+					},
+				},
 				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					Expect(os.Mkdir(filepath.Join(tmpSrc, "matched-subdir"), os.ModePerm)).To(Succeed())
 					Expect(os.Mkdir(filepath.Join(tmpSrc, "subdir"), os.ModePerm)).To(Succeed())
-					touchFile(filepath.Join(tmpSrc, "subdir", "file1"))
-					touchFile(filepath.Join(tmpSrc, "subdir", "file2"))
+					Expect(os.WriteFile(filepath.Join(tmpSrc, "matched-subdir", "file"), []byte("content"), 0o644)).To(Succeed())
+					Expect(os.Link(filepath.Join(tmpSrc, "matched-subdir", "file"), filepath.Join(tmpSrc, "subdir", "link"))).To(Succeed())
+					Expect(os.Link(filepath.Join(tmpSrc, "matched-subdir", "file"), filepath.Join(tmpSrc, "link"))).To(Succeed())
+					Expect(os.Link(filepath.Join(tmpSrc, "matched-subdir", "file"), filepath.Join(tmpSrc, "unmatched-file"))).To(Succeed())
 
-					Expect(os.Mkdir(filepath.Join(tmpDest, "subdir"), os.ModePerm)).To(Succeed())
-					touchFile(filepath.Join(tmpDest, "subdir", "file2"))
-					touchFile(filepath.Join(tmpDest, "subdir", "file3"))
+					touchFile(filepath.Join(tmpDest, "link"))
 				},
 				ExpectedFunc: func(config CopyRecurseTestConfig) {
-					Expect(filepath.Join(tmpDest, "subdir", "file1")).To(BeAnExistingFile())
-					Expect(filepath.Join(tmpDest, "subdir", "file2")).To(BeAnExistingFile())
-					Expect(filepath.Join(tmpDest, "subdir", "file3")).To(BeAnExistingFile())
+					_, stat := getFileInfoAndStat(filepath.Join(tmpDest, "matched-subdir", "file"))
+					Expect(stat.Nlink).To(BeEquivalentTo(3))
+
+					for _, link := range []string{filepath.Join("subdir", "link"), "link"} {
+						_, linkStat := getFileInfoAndStat(filepath.Join(tmpDest, link))
+						Expect(linkStat.Ino).To(Equal(stat.Ino))
+						Expect(getFileContent(filepath.Join(tmpDest, link))).To(Equal("content"))
+					}
+
+					Expect(filepath.Join(tmpDest, "unmatched-file")).ToNot(BeAnExistingFile())
 				},
 			},
 		),
-		Entry("replace existing files of different types",
+		Entry("preserve hard links to files of fully matched directory",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					PreserveHardLinks: true,
+					MatchDir: func(path string) (copyrec.DirAction, error) {
+						if filepath.Base(path) == "m" {
+							return copyrec.DirMatch, nil
+						}
+						return copyrec.DirFallThrough, nil
+					},
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					Expect(os.Mkdir(filepath.Join(tmpSrc, "m"), os.ModePerm)).To(Succeed())
+					Expect(os.Mkdir(filepath.Join(tmpSrc, "s"), os.ModePerm)).To(Succeed())
+					Expect(os.WriteFile(filepath.Join(tmpSrc, "m", "file"), []byte("content"), 0o644)).To(Succeed())
+					Expect(os.Link(filepath.Join(tmpSrc, "m", "file"), filepath.Join(tmpSrc, "s", "link"))).To(Succeed())
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					_, stat := getFileInfoAndStat(filepath.Join(tmpDest, "m", "file"))
+					_, linkStat := getFileInfoAndStat(filepath.Join(tmpDest, "s", "link"))
+					Expect(linkStat.Ino).To(Equal(stat.Ino))
+					Expect(stat.Nlink).To(BeEquivalentTo(2))
+					Expect(getFileContent(filepath.Join(tmpDest, "m", "file"))).To(Equal("content"))
+				},
+			},
+		),
+		Entry("copy hard linked files independently by default",
 			CopyRecurseTestConfig{
 				CopyRecurseOptions: copyrec.Options{},
 				CreateFilesFunc: func(config CopyRecurseTestConfig) {
-					Expect(os.Mkdir(filepath.Join(tmpSrc, "subdir"), os.ModePerm)).To(Succeed())
-					touchFile(filepath.Join(tmpSrc, "file"))
-
-					touchFile(filepath.Join(tmpDest, "subdir"))
-					Expect(os.Mkdir(filepath.Join(tmpDest, "file"), os.ModePerm)).To(Succeed())
+					Expect(os.WriteFile(filepath.Join(tmpSrc, "file"), []byte("content"), 0o644)).To(Succeed())
+					Expect(os.Link(filepath.Join(tmpSrc, "file"), filepath.Join(tmpSrc, "link"))).To(Succeed())
 				},
 				ExpectedFunc: func(config CopyRecurseTestConfig) {
-					Expect(filepath.Join(tmpDest, "subdir")).To(BeADirectory())
-					Expect(filepath.Join(tmpDest, "file")).To(BeARegularFile())
+					_, stat := getFileInfoAndStat(filepath.Join(tmpDest, "file"))
+					_, linkStat := getFileInfoAndStat(filepath.Join(tmpDest, "link"))
+					Expect(linkStat.Ino).ToNot(Equal(stat.Ino))
+					Expect(stat.Nlink).To(BeEquivalentTo(1))
 				},
 			},
 		),
-		Entry("complex test, first debug smaller tests if they broke too",
+		Entry("preserve times of files, directories and symlinks",
 			CopyRecurseTestConfig{
 				CopyRecurseOptions: copyrec.Options{
-					MatchDir: func(path string) (copyrec.DirAction, error) {
-						return copyrec.DirFallThrough, nil
-					},
-					MatchFile: func(path string) (bool, error) {
-						return filepath.Base(filepath.Clean(path)) != "notincluded", nil
-					},
-					// User not allowed to set UID to other than his own on *nix.
-					UID: intToUint32Ptr(os.Getuid()),
-					// User not allowed to set GID to other than one of his own groups on *nix.
-					GID: intToUint32Ptr(getFirstUserGroupSortedNumerically()),
+					PreserveTimes: true,
 				},
 				CreateFilesFunc: func(config CopyRecurseTestConfig) {
-					Expect(os.MkdirAll(filepath.Join(tmpSrc, "sd", "sd", "sd"), 0o750)).To(Succeed())
-					Expect(os.WriteFile(filepath.Join(tmpSrc, "sd", "sd", "file1"), []byte("content1"), 0o754)).To(Succeed())
-					Expect(os.WriteFile(filepath.Join(tmpSrc, "sd", "sd", "file2"), []byte("content2"), 0o754)).To(Succeed())
-					Expect(os.WriteFile(filepath.Join(tmpSrc, "sd", "sd", "sd", "file3"), []byte("content3"), 0o745)).To(Succeed())
-					Expect(os.Mkdir(filepath.Join(tmpSrc, "sd", "sd", "emptydir1"), 0o754)).To(Succeed())
-					Expect(os.Symlink("somewhere", filepath.Join(tmpSrc, "sd", "sd", "sd", "symlink"))).To(Succeed())
-					Expect(syscall.Mkfifo(filepath.Join(tmpSrc, "sd", "sd", "unsupported"), uint32(os.ModePerm))).To(Succeed())
-					Expect(os.MkdirAll(filepath.Join(tmpSrc, "sd2", "sd", "sd"), 0o750)).To(Succeed())
-					Expect(os.WriteFile(filepath.Join(tmpSrc, "sd2", "sd", "file5"), []byte("content5"), 0o754)).To(Succeed())
-					touchFile(filepath.Join(tmpSrc, "sd2", "sd", "sd", "notincluded"))
+					Expect(os.MkdirAll(filepath.Join(tmpSrc, "subdir", "subsubdir"), os.ModePerm)).To(Succeed())
+					Expect(os.WriteFile(filepath.Join(tmpSrc, "subdir", "subsubdir", "file"), []byte("content"), 0o644)).To(Succeed())
+					Expect(os.Symlink("somewhere", filepath.Join(tmpSrc, "subdir", "symlink"))).To(Succeed())
 
-					Expect(os.MkdirAll(filepath.Join(tmpDest, "sd", "sd"), 0o754)).To(Succeed())
-					Expect(os.WriteFile(filepath.Join(tmpDest, "sd", "sd", "file2"), []byte("oldcontent2"), 0o745)).To(Succeed())
-					Expect(os.WriteFile(filepath.Join(tmpDest, "sd", "sd", "file4"), []byte("oldcontent4"), 0o745)).To(Succeed())
-					Expect(os.Mkdir(filepath.Join(tmpDest, "sd", "emptydir2"), 0o744)).To(Succeed())
-					touchFile(filepath.Join(tmpDest, "sd2"))
+					for i, path := range timesTestPaths {
+						setTimes(filepath.Join(tmpSrc, path), time.Unix(1000000000+int64(i), 123456789))
+					}
 				},
 				ExpectedFunc: func(config CopyRecurseTestConfig) {
-					subDirParts := []string{"sd", "sd", "sd"}
-					for i := 0; i < len(subDirParts); i++ {
-						fi, stat := getFileInfoAndStat(filepath.Join(tmpDest, filepath.Join(subDirParts[:i+1]...)))
-						Expect(fi.IsDir()).To(BeTrue())
-						Expect(fi.Mode().Perm().String()).To(Equal(os.FileMode(0o750).String()))
-						Expect(stat.Uid).To(Equal(uint32(os.Getuid())))
-						Expect(stat.Gid).To(Equal(uint32(getFirstUserGroupSortedNumerically())))
-					}
+					// Source atimes could be updated while copying, so comparing with initially set times.
+					for i, path := range timesTestPaths {
+						atime, mtime := getTimes(filepath.Join(tmpDest, path))
+						Expect(mtime).To(Equal(time.Unix(1000000000+int64(i), 123456789)), path)
 
-					fi, stat := getFileInfoAndStat(filepath.Join(tmpDest, "sd", "sd", "file1"))
-					Expect(fi.Mode().IsRegular()).To(BeTrue())
-					Expect(fi.Mode().Perm().String()).To(Equal(os.FileMode(0o754).String()))
-					Expect(stat.Uid).To(Equal(uint32(os.Getuid())))
-					Expect(stat.Gid).To(Equal(uint32(getFirstUserGroupSortedNumerically())))
-					Expect(getFileContent(filepath.Join(tmpDest, "sd", "sd", "file1"))).To(Equal("content1"))
+						// Source root dir atime updated when walking it before its times are read.
+						if path != "." {
+							Expect(atime).To(Equal(time.Unix(1000000000+int64(i), 123456789)), path)
+						}
+					}
+				},
+			},
+		),
+		Entry("copy matching extended attributes of files and directories",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					CopyXattrs:    true,
+					XattrIncludes: []string{"user.*"},
+					XattrExcludes: []string{"user.excluded"},
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					Expect(os.Mkdir(filepath.Join(tmpSrc, "subdir"), os.ModePerm)).To(Succeed())
+					touchFile(filepath.Join(tmpSrc, "subdir", "file"))
 
-					fi, stat = getFileInfoAndStat(filepath.Join(tmpDest, "sd", "sd", "file2"))
-					Expect(fi.Mode().IsRegular()).To(BeTrue())
-					Expect(fi.Mode().Perm().String()).To(Equal(os.FileMode(0o754).String()))
-					Expect(stat.Uid).To(Equal(uint32(os.Getuid())))
-					Expect(stat.Gid).To(Equal(uint32(getFirstUserGroupSortedNumerically())))
-					Expect(getFileContent(filepath.Join(tmpDest, "sd", "sd", "file2"))).To(Equal("content2"))
+					for _, path := range []string{"subdir", filepath.Join("subdir", "file")} {
+						setXattrOrSkip(filepath.Join(tmpSrc, path), "user.included", "value")
+						setXattrOrSkip(filepath.Join(tmpSrc, path), "user.excluded", "value")
+					}
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					for _, path := range []string{"subdir", filepath.Join("subdir", "file")} {
+						Expect(getXattr(filepath.Join(tmpDest, path), "user.included")).To(Equal("value"))
 
-					fi, stat = getFileInfoAndStat(filepath.Join(tmpDest, "sd", "sd", "sd", "file3"))
+						_, err := getXattr(filepath.Join(tmpDest, path), "user.excluded")
+						Expect(err).To(MatchError(errXattrNotFound))
+					}
+				},
+			},
+		),
+		Entry("copy extended attributes of symlinks",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					CopyXattrs: true,
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					// Attributes of user namespace can't be set on symlinks.
+					if os.Geteuid() != 0 {
+						Skip("setting trusted extended attributes requires root")
+					}
+
+					Expect(os.Symlink("somewhere", filepath.Join(tmpSrc, "symlink"))).To(Succeed())
+					setXattrOrSkip(filepath.Join(tmpSrc, "symlink"), "trusted.copyrec", "value")
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					Expect(os.Readlink(filepath.Join(tmpDest, "symlink"))).To(Equal("somewhere"))
+					Expect(getXattr(filepath.Join(tmpDest, "symlink"), "trusted.copyrec")).To(Equal("value"))
+				},
+			},
+		),
+		Entry("copy files in parallel",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					Concurrency:       4,
+					PreserveHardLinks: true,
+					PreserveTimes:     true,
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					for i := 0; i < 10; i++ {
+						dir := filepath.Join(tmpSrc, fmt.Sprintf("dir%d", i), "subdir")
+						Expect(os.MkdirAll(dir, 0o755)).To(Succeed())
+
+						for j := 0; j < 10; j++ {
+							Expect(os.WriteFile(filepath.Join(dir, fmt.Sprintf("file%d", j)), []byte(fmt.Sprintf("content%d%d", i, j)), 0o644)).To(Succeed())
+						}
+						Expect(os.Link(filepath.Join(dir, "file0"), filepath.Join(dir, "link"))).To(Succeed())
+
+						Expect(os.Chmod(filepath.Join(tmpSrc, fmt.Sprintf("dir%d", i)), 0o555)).To(Succeed())
+					}
+
+					DeferCleanup(makeDirsWritable, tmpRoot)
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					for i := 0; i < 10; i++ {
+						dir := filepath.Join(tmpDest, fmt.Sprintf("dir%d", i), "subdir")
+						for j := 0; j < 10; j++ {
+							Expect(getFileContent(filepath.Join(dir, fmt.Sprintf("file%d", j)))).To(Equal(fmt.Sprintf("content%d%d", i, j)))
+						}
+
+						_, stat := getFileInfoAndStat(filepath.Join(dir, "file0"))
+						_, linkStat := getFileInfoAndStat(filepath.Join(dir, "link"))
+						Expect(linkStat.Ino).To(Equal(stat.Ino))
+
+						fi, _ := getFileInfoAndStat(filepath.Join(tmpDest, fmt.Sprintf("dir%d", i)))
+						Expect(fi.Mode().String()).To(Equal(os.FileMode(0o555 | os.ModeDir).String()))
+					}
+				},
+			},
+		),
+		Entry("report progress",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					Progress:         recordProgress,
+					ProgressInterval: time.Nanosecond,
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					Expect(os.Mkdir(filepath.Join(tmpSrc, "dir"), 0o755)).To(Succeed())
+					Expect(os.WriteFile(filepath.Join(tmpSrc, "dir", "a"), []byte("aaa"), 0o644)).To(Succeed())
+					Expect(os.WriteFile(filepath.Join(tmpSrc, "b"), []byte("bbbb"), 0o644)).To(Succeed())
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					Expect(len(reportedProgress)).To(BeNumerically(">", 1))
+					Expect(reportedProgress[len(reportedProgress)-1]).To(Equal(copyrec.Progress{
+						EntriesWalked:  4,
+						EntriesMatched: 3,
+						FilesCopied:    2,
+						BytesCopied:    7,
+						CurrentPath:    filepath.Join(tmpSrc, "dir", "a"),
+					}))
+				},
+			},
+		),
+		Entry("report progress only after copying with long interval",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					Progress:         recordProgress,
+					ProgressInterval: time.Hour,
+					Concurrency:      4,
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					for i := 0; i < 10; i++ {
+						touchFile(filepath.Join(tmpSrc, fmt.Sprintf("file%d", i)))
+					}
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					// The first update is reported right away, the final one after copying.
+					Expect(reportedProgress).To(HaveLen(2))
+					Expect(reportedProgress[1].FilesCopied).To(Equal(int64(10)))
+				},
+			},
+		),
+		Entry("replace files and symlinks atomically",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					AtomicReplace:     true,
+					PreserveHardLinks: true,
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					Expect(os.WriteFile(filepath.Join(tmpSrc, "file"), []byte("new"), 0o640)).To(Succeed())
+					Expect(os.Link(filepath.Join(tmpSrc, "file"), filepath.Join(tmpSrc, "link"))).To(Succeed())
+					Expect(os.Symlink("file", filepath.Join(tmpSrc, "symlink"))).To(Succeed())
+
+					Expect(os.WriteFile(filepath.Join(tmpDest, "file"), []byte("old"), 0o600)).To(Succeed())
+					Expect(os.Link(filepath.Join(tmpDest, "file"), filepath.Join(tmpDest, "file-old"))).To(Succeed())
+					Expect(os.MkdirAll(filepath.Join(tmpDest, "link", "dir"), 0o755)).To(Succeed())
+					Expect(os.Symlink("old", filepath.Join(tmpDest, "symlink"))).To(Succeed())
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					fi, _ := getFileInfoAndStat(filepath.Join(tmpDest, "file"))
+					Expect(fi.Mode().String()).To(Equal(os.FileMode(0o640).String()))
+					Expect(getFileContent(filepath.Join(tmpDest, "file"))).To(Equal("new"))
+					Expect(getFileContent(filepath.Join(tmpDest, "file-old"))).To(Equal("old"))
+					Expect(getFileContent(filepath.Join(tmpDest, "link"))).To(Equal("new"))
+					Expect(os.Readlink(filepath.Join(tmpDest, "symlink"))).To(Equal("file"))
+
+					tmpFiles, err := filepath.Glob(filepath.Join(tmpDest, ".*.tmp"))
+					Expect(err).ToNot(HaveOccurred())
+					Expect(tmpFiles).To(BeEmpty())
+				},
+			},
+		),
+		Entry("replace files with names of maximum length atomically",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					AtomicReplace: true,
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					name := strings.Repeat("ф", 127) + "f"
+					Expect(os.WriteFile(filepath.Join(tmpSrc, name), []byte("new"), 0o640)).To(Succeed())
+					Expect(os.WriteFile(filepath.Join(tmpDest, name), []byte("old"), 0o640)).To(Succeed())
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					Expect(getFileContent(filepath.Join(tmpDest, strings.Repeat("ф", 127)+"f"))).To(Equal("new"))
+
+					tmpFiles, err := filepath.Glob(filepath.Join(tmpDest, ".*.tmp"))
+					Expect(err).ToNot(HaveOccurred())
+					Expect(tmpFiles).To(BeEmpty())
+				},
+			},
+		),
+		Entry("mirror matched directories and files",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					Mirror: true,
+					MirrorProtect: func(destPath string) (bool, error) {
+						return filepath.Base(destPath) == "protected.txt", nil
+					},
+					MatchDir: func(path string) (copyrec.DirAction, error) {
+						switch filepath.Base(path) {
+						case "matched":
+							return copyrec.DirMatch, nil
+						case "skipped":
+							return copyrec.DirSkip, nil
+						default:
+							return copyrec.DirFallThrough, nil
+						}
+					},
+					MatchFile: func(path string) (bool, error) {
+						return filepath.Ext(path) == ".txt", nil
+					},
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					touchFile(filepath.Join(tmpSrc, "file.txt"))
+					Expect(os.Mkdir(filepath.Join(tmpSrc, "matched"), 0o755)).To(Succeed())
+					touchFile(filepath.Join(tmpSrc, "matched", "file"))
+					Expect(os.Mkdir(filepath.Join(tmpSrc, "skipped"), 0o755)).To(Succeed())
+
+					for _, path := range []string{
+						"extra.txt", "extra.bin", "protected.txt",
+						"matched/extra", "matched/subdir/extra",
+						"skipped/extra.txt",
+						"gone/extra.txt", "gone/extra.bin",
+					} {
+						Expect(os.MkdirAll(filepath.Dir(filepath.Join(tmpDest, path)), 0o755)).To(Succeed())
+						touchFile(filepath.Join(tmpDest, path))
+					}
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					for _, path := range []string{"file.txt", "matched/file", "extra.bin", "protected.txt", "skipped/extra.txt", "gone/extra.bin"} {
+						Expect(filepath.Join(tmpDest, path)).To(BeARegularFile())
+					}
+
+					for _, path := range []string{"extra.txt", "matched/extra", "matched/subdir", "gone/extra.txt"} {
+						Expect(filepath.Join(tmpDest, path)).ToNot(BeAnExistingFile())
+					}
+				},
+			},
+		),
+		Entry("skip files with the same size and modification time and update their mode",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					CompareMethod: copyrec.CompareSizeAndModTime,
+					PreserveTimes: true,
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+					for _, name := range []string{"unchanged", "changed"} {
+						Expect(os.WriteFile(filepath.Join(tmpSrc, name), []byte("new"), 0o644)).To(Succeed())
+						Expect(os.WriteFile(filepath.Join(tmpDest, name), []byte("old"), 0o600)).To(Succeed())
+						Expect(os.Chtimes(filepath.Join(tmpSrc, name), modTime, modTime)).To(Succeed())
+					}
+					Expect(os.Chtimes(filepath.Join(tmpDest, "unchanged"), modTime, modTime)).To(Succeed())
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					Expect(getFileContent(filepath.Join(tmpDest, "unchanged"))).To(Equal("old"))
+					Expect(getFileContent(filepath.Join(tmpDest, "changed"))).To(Equal("new"))
+
+					fi, _ := getFileInfoAndStat(filepath.Join(tmpDest, "unchanged"))
+					Expect(fi.Mode().String()).To(Equal(os.FileMode(0o644).String()))
+				},
+			},
+		),
+		Entry("copy files with the same size and modification time but different mode",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					CompareMethod: copyrec.CompareSizeModTimeModeAndOwner,
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+					Expect(os.WriteFile(filepath.Join(tmpSrc, "file"), []byte("new"), 0o644)).To(Succeed())
+					Expect(os.WriteFile(filepath.Join(tmpDest, "file"), []byte("old"), 0o600)).To(Succeed())
+					Expect(os.Chtimes(filepath.Join(tmpSrc, "file"), modTime, modTime)).To(Succeed())
+					Expect(os.Chtimes(filepath.Join(tmpDest, "file"), modTime, modTime)).To(Succeed())
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					Expect(getFileContent(filepath.Join(tmpDest, "file"))).To(Equal("new"))
+				},
+			},
+		),
+		Entry("merge directories",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					Expect(os.Mkdir(filepath.Join(tmpSrc, "subdir"), os.ModePerm)).To(Succeed())
+					touchFile(filepath.Join(tmpSrc, "subdir", "file1"))
+					touchFile(filepath.Join(tmpSrc, "subdir", "file2"))
+
+					Expect(os.Mkdir(filepath.Join(tmpDest, "subdir"), os.ModePerm)).To(Succeed())
+					touchFile(filepath.Join(tmpDest, "subdir", "file2"))
+					touchFile(filepath.Join(tmpDest, "subdir", "file3"))
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					Expect(filepath.Join(tmpDest, "subdir", "file1")).To(BeAnExistingFile())
+					Expect(filepath.Join(tmpDest, "subdir", "file2")).To(BeAnExistingFile())
+					Expect(filepath.Join(tmpDest, "subdir", "file3")).To(BeAnExistingFile())
+				},
+			},
+		),
+		Entry("replace existing files of different types",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					Expect(os.Mkdir(filepath.Join(tmpSrc, "subdir"), os.ModePerm)).To(Succeed())
+					touchFile(filepath.Join(tmpSrc, "file"))
+
+					touchFile(filepath.Join(tmpDest, "subdir"))
+					Expect(os.Mkdir(filepath.Join(tmpDest, "file"), os.ModePerm)).To(Succeed())
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					Expect(filepath.Join(tmpDest, "subdir")).To(BeADirectory())
+					Expect(filepath.Join(tmpDest, "file")).To(BeARegularFile())
+				},
+			},
+		),
+		Entry("complex test, first debug smaller tests if they broke too",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					MatchDir: func(path string) (copyrec.DirAction, error) {
+						return copyrec.DirFallThrough, nil
+					},
+					MatchFile: func(path string) (bool, error) {
+						return filepath.Base(filepath.Clean(path)) != "notincluded", nil
+					},
+					// User not allowed to set UID to other than his own on *nix.
+					UID: intToUint32Ptr(os.Getuid()),
+					// User not allowed to set GID to other than one of his own groups on *nix.
+					GID: intToUint32Ptr(getFirstUserGroupSortedNumerically()),
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					Expect(os.MkdirAll(filepath.Join(tmpSrc, "sd", "sd", "sd"), 0o750)).To(Succeed())
+					Expect(os.WriteFile(filepath.Join(tmpSrc, "sd", "sd", "file1"), []byte("content1"), 0o754)).To(Succeed())
+					Expect(os.WriteFile(filepath.Join(tmpSrc, "sd", "sd", "file2"), []byte("content2"), 0o754)).To(Succeed())
+					Expect(os.WriteFile(filepath.Join(tmpSrc, "sd", "sd", "sd", "file3"), []byte("content3"), 0o745)).To(Succeed())
+					Expect(os.Mkdir(filepath.Join(tmpSrc, "sd", "sd", "emptydir1"), 0o754)).To(Succeed())
+					Expect(os.Symlink("somewhere", filepath.Join(tmpSrc, "sd", "sd", "sd", "symlink"))).To(Succeed())
+					Expect(unix.Mkfifo(filepath.Join(tmpSrc, "sd", "sd", "unsupported"), uint32(os.ModePerm))).To(Succeed())
+					Expect(os.MkdirAll(filepath.Join(tmpSrc, "sd2", "sd", "sd"), 0o750)).To(Succeed())
+					Expect(os.WriteFile(filepath.Join(tmpSrc, "sd2", "sd", "file5"), []byte("content5"), 0o754)).To(Succeed())
+					touchFile(filepath.Join(tmpSrc, "sd2", "sd", "sd", "notincluded"))
+
+					Expect(os.MkdirAll(filepath.Join(tmpDest, "sd", "sd"), 0o754)).To(Succeed())
+					Expect(os.WriteFile(filepath.Join(tmpDest, "sd", "sd", "file2"), []byte("oldcontent2"), 0o745)).To(Succeed())
+					Expect(os.WriteFile(filepath.Join(tmpDest, "sd", "sd", "file4"), []byte("oldcontent4"), 0o745)).To(Succeed())
+					Expect(os.Mkdir(filepath.Join(tmpDest, "sd", "emptydir2"), 0o744)).To(Succeed())
+					touchFile(filepath.Join(tmpDest, "sd2"))
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					subDirParts := []string{"sd", "sd", "sd"}
+					for i := 0; i < len(subDirParts); i++ {
+						fi, stat := getFileInfoAndStat(filepath.Join(tmpDest, filepath.Join(subDirParts[:i+1]...)))
+						Expect(fi.IsDir()).To(BeTrue())
+						Expect(fi.Mode().Perm().String()).To(Equal(os.FileMode(0o750).String()))
+						Expect(stat.Uid).To(Equal(uint32(os.Getuid())))
+						Expect(stat.Gid).To(Equal(uint32(getFirstUserGroupSortedNumerically())))
+					}
+
+					fi, stat := getFileInfoAndStat(filepath.Join(tmpDest, "sd", "sd", "file1"))
+					Expect(fi.Mode().IsRegular()).To(BeTrue())
+					Expect(fi.Mode().Perm().String()).To(Equal(os.FileMode(0o754).String()))
+					Expect(stat.Uid).To(Equal(uint32(os.Getuid())))
+					Expect(stat.Gid).To(Equal(uint32(getFirstUserGroupSortedNumerically())))
+					Expect(getFileContent(filepath.Join(tmpDest, "sd", "sd", "file1"))).To(Equal("content1"))
+
+					fi, stat = getFileInfoAndStat(filepath.Join(tmpDest, "sd", "sd", "file2"))
+					Expect(fi.Mode().IsRegular()).To(BeTrue())
+					Expect(fi.Mode().Perm().String()).To(Equal(os.FileMode(0o754).String()))
+					Expect(stat.Uid).To(Equal(uint32(os.Getuid())))
+					Expect(stat.Gid).To(Equal(uint32(getFirstUserGroupSortedNumerically())))
+					Expect(getFileContent(filepath.Join(tmpDest, "sd", "sd", "file2"))).To(Equal("content2"))
+
+					fi, stat = getFileInfoAndStat(filepath.Join(tmpDest, "sd", "sd", "sd", "file3"))
 					Expect(fi.Mode().IsRegular()).To(BeTrue())
 					Expect(fi.Mode().Perm().String()).To(Equal(os.FileMode(0o745).String()))
 					Expect(stat.Uid).To(Equal(uint32(os.Getuid())))
@@ -415,30 +1067,892 @@ var _ = Describe("CopyRecurse", func() {
 				},
 			},
 		),
-	)
-})
-
-func intToUint32Ptr(n int) *uint32 {
-	converted := uint32(n)
-	return &converted
-}
-
-func getFirstUserGroupSortedNumerically() int {
-	groups, err := os.Getgroups()
-	Expect(err).ToNot(HaveOccurred())
-	return groups[0]
-}
+		Entry("copy symlink targets instead of symlinks",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					Symlinks: copyrec.SymlinkFollow,
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					outside := filepath.Join(tmpRoot, "outside")
+					Expect(os.MkdirAll(filepath.Join(outside, "subdir"), 0o750)).To(Succeed())
+					Expect(os.WriteFile(filepath.Join(outside, "subdir", "file"), []byte("content"), 0o640)).To(Succeed())
+					Expect(os.Symlink("file", filepath.Join(outside, "subdir", "filesymlink"))).To(Succeed())
 
-func touchFile(path string) {
-	_, err := os.Create(path)
-	Expect(err).ToNot(HaveOccurred())
-}
+					Expect(os.Symlink(outside, filepath.Join(tmpSrc, "dirsymlink"))).To(Succeed())
+					Expect(os.Symlink(filepath.Join("dirsymlink", "subdir", "file"), filepath.Join(tmpSrc, "filesymlink"))).To(Succeed())
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					fi, _ := getFileInfoAndStat(filepath.Join(tmpDest, "dirsymlink"))
+					Expect(fi.IsDir()).To(BeTrue())
+					Expect(fi.Mode().Perm().String()).To(Equal(os.FileMode(0o750).String()))
 
-func getFileInfoAndStat(path string) (os.FileInfo, *syscall.Stat_t) {
-	fileInfo, err := os.Lstat(path)
-	Expect(err).ToNot(HaveOccurred())
+					for _, path := range []string{"filesymlink", filepath.Join("dirsymlink", "subdir", "file"), filepath.Join("dirsymlink", "subdir", "filesymlink")} {
+						fi, _ = getFileInfoAndStat(filepath.Join(tmpDest, path))
+						Expect(fi.Mode().IsRegular()).To(BeTrue())
+						Expect(fi.Mode().Perm().String()).To(Equal(os.FileMode(0o640).String()))
+						Expect(getFileContent(filepath.Join(tmpDest, path))).To(Equal("content"))
+					}
+				},
+			},
+		),
+		Entry("match entries below followed symlinks to directories",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					Symlinks: copyrec.SymlinkFollow,
+					MatchDir: func(path string) (copyrec.DirAction, error) {
+						if filepath.Base(path) == "skipped" {
+							return copyrec.DirSkip, nil
+						}
+						return copyrec.DirFallThrough, nil
+					},
+					MatchFile: func(path string) (bool, error) {
+						// Paths are below the symlink, not below its target.
+						Expect(path).To(HavePrefix(tmpSrc))
+						return filepath.Ext(path) != ".log", nil
+					},
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					outside := filepath.Join(tmpRoot, "outside")
+					for _, dir := range []string{"subdir", "skipped"} {
+						Expect(os.MkdirAll(filepath.Join(outside, dir), 0o750)).To(Succeed())
+					}
+					for _, path := range []string{"file", "debug.log", filepath.Join("subdir", "file"), filepath.Join("subdir", "debug.log"), filepath.Join("skipped", "file")} {
+						touchFile(filepath.Join(outside, path))
+					}
 
-	return fileInfo, fileInfo.Sys().(*syscall.Stat_t)
+					Expect(os.Symlink(outside, filepath.Join(tmpSrc, "dirsymlink"))).To(Succeed())
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					Expect(filepath.Join(tmpDest, "dirsymlink")).To(BeADirectory())
+					Expect(filepath.Join(tmpDest, "dirsymlink", "file")).To(BeARegularFile())
+					Expect(filepath.Join(tmpDest, "dirsymlink", "subdir", "file")).To(BeARegularFile())
+					Expect(filepath.Join(tmpDest, "dirsymlink", "debug.log")).ToNot(BeAnExistingFile())
+					Expect(filepath.Join(tmpDest, "dirsymlink", "subdir", "debug.log")).ToNot(BeAnExistingFile())
+					Expect(filepath.Join(tmpDest, "dirsymlink", "skipped")).ToNot(BeAnExistingFile())
+				},
+			},
+		),
+		Entry("rewrite absolute symlink destinations inside source",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					Symlinks: copyrec.SymlinkRewriteAbsolute,
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					Expect(os.Mkdir(filepath.Join(tmpSrc, "dir"), 0o755)).To(Succeed())
+					touchFile(filepath.Join(tmpSrc, "file"))
+					Expect(os.Symlink(filepath.Join(tmpSrc, "file"), filepath.Join(tmpSrc, "dir", "inside"))).To(Succeed())
+					Expect(os.Symlink(tmpRoot, filepath.Join(tmpSrc, "dir", "outside"))).To(Succeed())
+					Expect(os.Symlink("../file", filepath.Join(tmpSrc, "dir", "relative"))).To(Succeed())
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					Expect(os.Readlink(filepath.Join(tmpDest, "dir", "inside"))).To(Equal(filepath.Join("..", "file")))
+					Expect(os.Readlink(filepath.Join(tmpDest, "dir", "outside"))).To(Equal(tmpRoot))
+					Expect(os.Readlink(filepath.Join(tmpDest, "dir", "relative"))).To(Equal("../file"))
+				},
+			},
+		),
+		Entry("skip dangling symlinks",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					Symlinks: copyrec.SymlinkSkipDangling,
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					Expect(os.Mkdir(filepath.Join(tmpSrc, "dir"), 0o755)).To(Succeed())
+					touchFile(filepath.Join(tmpSrc, "file"))
+					Expect(os.Symlink("../file", filepath.Join(tmpSrc, "dir", "symlink"))).To(Succeed())
+					Expect(os.Symlink("../missing", filepath.Join(tmpSrc, "dir", "dangling"))).To(Succeed())
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					Expect(os.Readlink(filepath.Join(tmpDest, "dir", "symlink"))).To(Equal("../file"))
+					Expect(filepath.Join(tmpDest, "dir", "dangling")).ToNot(BeAnExistingFile())
+				},
+			},
+		),
+		Entry("copy without following symlinks in destination",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					SafeDest:          true,
+					AtomicReplace:     true,
+					Mirror:            true,
+					PreserveHardLinks: true,
+					PreserveTimes:     true,
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					Expect(os.MkdirAll(filepath.Join(tmpSrc, "dir", "subdir"), 0o750)).To(Succeed())
+					Expect(os.WriteFile(filepath.Join(tmpSrc, "dir", "file"), []byte("new"), 0o640)).To(Succeed())
+					Expect(os.Link(filepath.Join(tmpSrc, "dir", "file"), filepath.Join(tmpSrc, "dir", "subdir", "link"))).To(Succeed())
+					Expect(os.Symlink("file", filepath.Join(tmpSrc, "dir", "symlink"))).To(Succeed())
+					Expect(os.Mkdir(filepath.Join(tmpSrc, "replaced"), 0o755)).To(Succeed())
+					touchFile(filepath.Join(tmpSrc, "replaced", "file"))
+
+					Expect(os.Mkdir(filepath.Join(tmpRoot, "outside"), 0o755)).To(Succeed())
+					Expect(os.Mkdir(filepath.Join(tmpDest, "dir"), 0o755)).To(Succeed())
+					Expect(os.WriteFile(filepath.Join(tmpDest, "dir", "file"), []byte("old"), 0o600)).To(Succeed())
+					touchFile(filepath.Join(tmpDest, "dir", "extra"))
+					Expect(os.Symlink(filepath.Join(tmpRoot, "outside"), filepath.Join(tmpDest, "replaced"))).To(Succeed())
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					fi, _ := getFileInfoAndStat(filepath.Join(tmpDest, "dir", "subdir"))
+					Expect(fi.Mode().String()).To(Equal(os.FileMode(0o750 | os.ModeDir).String()))
+					Expect(getFileContent(filepath.Join(tmpDest, "dir", "file"))).To(Equal("new"))
+					Expect(getFileContent(filepath.Join(tmpDest, "dir", "subdir", "link"))).To(Equal("new"))
+					Expect(os.Readlink(filepath.Join(tmpDest, "dir", "symlink"))).To(Equal("file"))
+					Expect(filepath.Join(tmpDest, "dir", "extra")).ToNot(BeAnExistingFile())
+					Expect(filepath.Join(tmpDest, "replaced")).To(BeADirectory())
+					Expect(filepath.Join(tmpDest, "replaced", "file")).To(BeARegularFile())
+
+					entries, err := os.ReadDir(filepath.Join(tmpRoot, "outside"))
+					Expect(err).ToNot(HaveOccurred())
+					Expect(entries).To(BeEmpty())
+				},
+			},
+		),
+	)
+
+	DescribeTable("should fail and",
+		func(config CopyRecurseTestConfig) {
+			config.CreateFilesFunc(config)
+
+			copyRec, err := copyrec.New(filepath.Join(tmpSrc, config.SrcRel), filepath.Join(tmpDest, config.DestRel), config.CopyRecurseOptions)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(copyRec.Run(ctx)).ToNot(Succeed())
+
+			config.ExpectedFunc(config)
+		},
+		Entry("stop copying files in parallel on error",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					Concurrency: 4,
+					CopyMethods: []copyrec.CopyMethod{copyrec.CopyMethod(-1)},
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					for i := 0; i < 100; i++ {
+						touchFile(filepath.Join(tmpSrc, fmt.Sprintf("file%d", i)))
+					}
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					Expect(filepath.Join(tmpDest, "file99")).ToNot(BeAnExistingFile())
+				},
+			},
+		),
+		Entry("set modes of already created read-only directories on error",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					MatchFile: func(path string) (bool, error) {
+						if filepath.Base(path) == "b" {
+							return false, errors.New("match error")
+						}
+						return true, nil
+					},
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					DeferCleanup(makeDirsWritable, tmpRoot)
+
+					Expect(os.Mkdir(filepath.Join(tmpSrc, "ro"), os.ModePerm)).To(Succeed())
+					touchFile(filepath.Join(tmpSrc, "ro", "a"))
+					touchFile(filepath.Join(tmpSrc, "ro", "b"))
+					Expect(os.Chmod(filepath.Join(tmpSrc, "ro"), 0o555)).To(Succeed())
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					Expect(filepath.Join(tmpDest, "ro", "a")).To(BeAnExistingFile())
+
+					fi, _ := getFileInfoAndStat(filepath.Join(tmpDest, "ro"))
+					Expect(fi.Mode().String()).To(Equal(os.FileMode(0o555 | os.ModeDir).String()))
+				},
+			},
+		),
+		Entry("keep replaced file and remove temporary file on error",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					AtomicReplace: true,
+					CopyMethods:   []copyrec.CopyMethod{copyrec.CopyMethod(-1)},
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					Expect(os.WriteFile(filepath.Join(tmpSrc, "file"), []byte("new"), 0o644)).To(Succeed())
+					Expect(os.WriteFile(filepath.Join(tmpDest, "file"), []byte("old"), 0o644)).To(Succeed())
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					Expect(getFileContent(filepath.Join(tmpDest, "file"))).To(Equal("old"))
+
+					tmpFiles, err := filepath.Glob(filepath.Join(tmpDest, ".*.tmp"))
+					Expect(err).ToNot(HaveOccurred())
+					Expect(tmpFiles).To(BeEmpty())
+				},
+			},
+		),
+		Entry("not follow symlink creating a loop",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					Symlinks: copyrec.SymlinkFollow,
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					Expect(os.MkdirAll(filepath.Join(tmpSrc, "dir", "subdir"), 0o755)).To(Succeed())
+					Expect(os.Symlink("..", filepath.Join(tmpSrc, "dir", "subdir", "loop"))).To(Succeed())
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					Expect(filepath.Join(tmpDest, "dir", "subdir", "loop")).ToNot(BeAnExistingFile())
+				},
+			},
+		),
+		Entry("not follow too many nested symlinks to directories",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					Symlinks:        copyrec.SymlinkFollow,
+					MaxSymlinkDepth: 1,
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					for _, dir := range []string{"a", "b"} {
+						Expect(os.Mkdir(filepath.Join(tmpRoot, dir), 0o755)).To(Succeed())
+					}
+					Expect(os.Symlink(filepath.Join(tmpRoot, "a"), filepath.Join(tmpSrc, "a"))).To(Succeed())
+					Expect(os.Symlink(filepath.Join(tmpRoot, "b"), filepath.Join(tmpRoot, "a", "b"))).To(Succeed())
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					Expect(filepath.Join(tmpDest, "a", "b")).ToNot(BeAnExistingFile())
+				},
+			},
+		),
+		Entry("not follow dangling symlink",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					Symlinks: copyrec.SymlinkFollow,
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					Expect(os.Symlink("missing", filepath.Join(tmpSrc, "dangling"))).To(Succeed())
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					Expect(filepath.Join(tmpDest, "dangling")).ToNot(BeAnExistingFile())
+				},
+			},
+		),
+		Entry("not copy symlink pointing outside of source",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					EscapingSymlinks: copyrec.EscapingSymlinkFail,
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					Expect(os.Symlink("../secret", filepath.Join(tmpSrc, "symlink"))).To(Succeed())
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					Expect(filepath.Join(tmpDest, "symlink")).ToNot(BeAnExistingFile())
+				},
+			},
+		),
+		Entry("not copy forbidden FIFO",
+			CopyRecurseTestConfig{
+				CopyRecurseOptions: copyrec.Options{
+					FIFOAction: copyrec.SpecialFileFail,
+				},
+				CreateFilesFunc: func(config CopyRecurseTestConfig) {
+					Expect(unix.Mkfifo(filepath.Join(tmpSrc, "fifo"), 0o640)).To(Succeed())
+				},
+				ExpectedFunc: func(config CopyRecurseTestConfig) {
+					Expect(filepath.Join(tmpDest, "fifo")).ToNot(BeAnExistingFile())
+				},
+			},
+		),
+	)
+
+	It("should report and skip symlinks pointing outside of source", func() {
+		Expect(os.Mkdir(filepath.Join(tmpRoot, "outside"), 0o755)).To(Succeed())
+		Expect(os.Mkdir(filepath.Join(tmpSrc, "dir"), 0o755)).To(Succeed())
+		touchFile(filepath.Join(tmpSrc, "file"))
+		Expect(os.Symlink(tmpRoot, filepath.Join(tmpSrc, "escape"))).To(Succeed())
+		Expect(os.Symlink("../../outside", filepath.Join(tmpSrc, "dir", "relative"))).To(Succeed())
+		Expect(os.Symlink("../escape/outside", filepath.Join(tmpSrc, "dir", "through"))).To(Succeed())
+		Expect(os.Symlink("../file", filepath.Join(tmpSrc, "dir", "inside"))).To(Succeed())
+		Expect(os.Symlink(filepath.Join(tmpSrc, "file"), filepath.Join(tmpSrc, "dir", "absolute"))).To(Succeed())
+
+		reported := map[string]string{}
+		copyRec, err := copyrec.New(tmpSrc, tmpDest, copyrec.Options{
+			EscapingSymlinks: copyrec.EscapingSymlinkSkip,
+			OnEscapingSymlink: func(src, linkDestination string, action copyrec.EscapingSymlinkAction) {
+				Expect(action).To(Equal(copyrec.EscapingSymlinkSkip))
+				reported[src] = linkDestination
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		result, err := copyRec.RunWithResult(ctx)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(reported).To(Equal(map[string]string{
+			filepath.Join(tmpSrc, "escape"):          tmpRoot,
+			filepath.Join(tmpSrc, "dir", "relative"): "../../outside",
+			filepath.Join(tmpSrc, "dir", "through"):  "../escape/outside",
+		}))
+		Expect(result.Skipped).To(Equal(int64(3)))
+
+		Expect(filepath.Join(tmpDest, "escape")).ToNot(BeAnExistingFile())
+		Expect(filepath.Join(tmpDest, "dir", "relative")).ToNot(BeAnExistingFile())
+		Expect(filepath.Join(tmpDest, "dir", "through")).ToNot(BeAnExistingFile())
+		Expect(os.Readlink(filepath.Join(tmpDest, "dir", "inside"))).To(Equal("../file"))
+		Expect(os.Readlink(filepath.Join(tmpDest, "dir", "absolute"))).To(Equal(filepath.Join(tmpSrc, "file")))
+	})
+
+	It("should rewrite symlinks pointing outside of source", func() {
+		Expect(os.Mkdir(filepath.Join(tmpSrc, "dir"), 0o755)).To(Succeed())
+		Expect(os.Symlink("/etc/passwd", filepath.Join(tmpSrc, "dir", "absolute"))).To(Succeed())
+		Expect(os.Symlink("../../../secret", filepath.Join(tmpSrc, "dir", "relative"))).To(Succeed())
+		Expect(os.Symlink("absolute", filepath.Join(tmpSrc, "dir", "through"))).To(Succeed())
+
+		copyRec, err := copyrec.New(tmpSrc, tmpDest, copyrec.Options{
+			EscapingSymlinks: copyrec.EscapingSymlinkRewrite,
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(copyRec.Run(ctx)).To(Succeed())
+
+		Expect(os.Readlink(filepath.Join(tmpDest, "dir", "absolute"))).To(Equal("../etc/passwd"))
+		Expect(os.Readlink(filepath.Join(tmpDest, "dir", "relative"))).To(Equal("../secret"))
+		Expect(os.Readlink(filepath.Join(tmpDest, "dir", "through"))).To(Equal("../etc/passwd"))
+	})
+
+	It("should not follow symlinks pointing outside of source if skipped", func() {
+		Expect(os.Mkdir(filepath.Join(tmpRoot, "outside"), 0o755)).To(Succeed())
+		touchFile(filepath.Join(tmpRoot, "outside", "file"))
+		touchFile(filepath.Join(tmpSrc, "file"))
+		Expect(os.Symlink(filepath.Join(tmpRoot, "outside"), filepath.Join(tmpSrc, "escape"))).To(Succeed())
+		Expect(os.Symlink("file", filepath.Join(tmpSrc, "inside"))).To(Succeed())
+
+		copyRec, err := copyrec.New(tmpSrc, tmpDest, copyrec.Options{
+			Symlinks:         copyrec.SymlinkFollow,
+			EscapingSymlinks: copyrec.EscapingSymlinkSkip,
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(copyRec.Run(ctx)).To(Succeed())
+
+		Expect(filepath.Join(tmpDest, "escape")).ToNot(BeAnExistingFile())
+		Expect(filepath.Join(tmpDest, "inside")).To(BeARegularFile())
+	})
+
+	It("should not allow rewriting symlinks pointing outside of source while following symlinks", func() {
+		_, err := copyrec.New(tmpSrc, tmpDest, copyrec.Options{
+			Symlinks:         copyrec.SymlinkFollow,
+			EscapingSymlinks: copyrec.EscapingSymlinkRewrite,
+		})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should not write outside of destination if its directory replaced with symlink while copying", func() {
+		Expect(os.Mkdir(filepath.Join(tmpSrc, "dir"), 0o755)).To(Succeed())
+		touchFile(filepath.Join(tmpSrc, "dir", "a"))
+		touchFile(filepath.Join(tmpSrc, "dir", "b"))
+		Expect(os.Mkdir(filepath.Join(tmpRoot, "outside"), 0o755)).To(Succeed())
+
+		copyRec, err := copyrec.New(tmpSrc, tmpDest, copyrec.Options{
+			SafeDest: true,
+			MatchFile: func(path string) (bool, error) {
+				// Destination directory created while copying the first file.
+				if path == filepath.Join(tmpSrc, "dir", "b") {
+					Expect(os.Rename(filepath.Join(tmpDest, "dir"), filepath.Join(tmpDest, "moved"))).To(Succeed())
+					Expect(os.Symlink(filepath.Join(tmpRoot, "outside"), filepath.Join(tmpDest, "dir"))).To(Succeed())
+				}
+				return true, nil
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(copyRec.Run(ctx)).ToNot(Succeed())
+
+		entries, err := os.ReadDir(filepath.Join(tmpRoot, "outside"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(BeEmpty())
+	})
+
+	It("should plan copying without changing destination", func() {
+		Expect(os.Mkdir(filepath.Join(tmpSrc, "dir"), 0o755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(tmpSrc, "dir", "file"), []byte("content"), 0o640)).To(Succeed())
+		Expect(os.Symlink("dir/file", filepath.Join(tmpSrc, "link"))).To(Succeed())
+
+		touchFile(filepath.Join(tmpDest, "dir"))
+		Expect(os.Mkdir(filepath.Join(tmpDest, "link"), 0o755)).To(Succeed())
+		touchFile(filepath.Join(tmpDest, "link", "file"))
+
+		copyRec, err := copyrec.New(tmpSrc, tmpDest, copyrec.Options{UID: intToUint32Ptr(os.Getuid()), GID: intToUint32Ptr(os.Getgid())})
+		Expect(err).ToNot(HaveOccurred())
+
+		plan, err := copyRec.Plan(ctx)
+		Expect(err).ToNot(HaveOccurred())
+
+		var planned []string
+		for _, action := range plan {
+			relPath, err := filepath.Rel(tmpDest, action.Path)
+			Expect(err).ToNot(HaveOccurred())
+			planned = append(planned, fmt.Sprintf("%s %s", action.Type, relPath))
+		}
+		Expect(planned).To(Equal([]string{
+			"chown .",
+			"replace dir",
+			"mkdir dir",
+			"chown dir",
+			"chmod dir",
+			"create-file dir/file",
+			"chown dir/file",
+			"chmod dir/file",
+			"remove-all link",
+			"create-symlink link",
+		}))
+		Expect(*plan[5].Mode).To(Equal(os.FileMode(0o640)))
+		Expect(plan[5].Src).To(Equal(filepath.Join(tmpSrc, "dir", "file")))
+		Expect(plan[9].Target).To(Equal("dir/file"))
+
+		planJSON, err := json.Marshal(plan)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(planJSON)).To(ContainSubstring(fmt.Sprintf(`{"type":"create-symlink","path":%q,"target":"dir/file"}`, filepath.Join(tmpDest, "link"))))
+
+		Expect(filepath.Join(tmpDest, "dir")).To(BeARegularFile())
+		Expect(filepath.Join(tmpDest, "link", "file")).To(BeARegularFile())
+
+		Expect(copyRec.Run(ctx)).To(Succeed())
+		Expect(getFileContent(filepath.Join(tmpDest, "dir", "file"))).To(Equal("content"))
+		Expect(os.Readlink(filepath.Join(tmpDest, "link"))).To(Equal("dir/file"))
+	})
+
+	It("should plan safe copying to destination with missing parent directory", func() {
+		touchFile(filepath.Join(tmpSrc, "file"))
+		dest := filepath.Join(tmpRoot, "missing", "dest")
+
+		copyRec, err := copyrec.New(tmpSrc, dest, copyrec.Options{SafeDest: true})
+		Expect(err).ToNot(HaveOccurred())
+
+		plan, err := copyRec.Plan(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(plan).ToNot(BeEmpty())
+		Expect(plan[0].Type).To(Equal(copyrec.PlanActionMkdir))
+		Expect(plan[0].Path).To(Equal(filepath.Join(tmpRoot, "missing")))
+		Expect(filepath.Join(tmpRoot, "missing")).ToNot(BeAnExistingFile())
+
+		Expect(copyRec.Run(ctx)).To(Succeed())
+		Expect(filepath.Join(dest, "file")).To(BeARegularFile())
+	})
+
+	It("should return result of copying", func() {
+		Expect(os.Mkdir(filepath.Join(tmpSrc, "dir"), 0o755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(tmpSrc, "dir", "file"), []byte("content"), 0o644)).To(Succeed())
+		Expect(os.Symlink("dir/file", filepath.Join(tmpSrc, "link"))).To(Succeed())
+		Expect(unix.Mkfifo(filepath.Join(tmpSrc, "fifo"), 0o640)).To(Succeed())
+
+		touchFile(filepath.Join(tmpDest, "link"))
+
+		copyRec, err := copyrec.New(tmpSrc, tmpDest, copyrec.Options{})
+		Expect(err).ToNot(HaveOccurred())
+
+		result, err := copyRec.RunWithResult(ctx)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(result.Elapsed).To(BeNumerically(">", 0))
+		result.Elapsed = 0
+		Expect(result).To(Equal(copyrec.Result{
+			Files:    1,
+			Dirs:     2,
+			Symlinks: 1,
+			Skipped:  1,
+			Bytes:    7,
+			Replaced: 1,
+		}))
+	})
+
+	It("should return empty result if nothing matched", func() {
+		touchFile(filepath.Join(tmpSrc, "file"))
+
+		copyRec, err := copyrec.New(tmpSrc, tmpDest, copyrec.Options{
+			MatchFile: func(path string) (bool, error) {
+				return false, nil
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		result, err := copyRec.RunWithResult(ctx)
+		Expect(err).ToNot(HaveOccurred())
+
+		result.Elapsed = 0
+		Expect(result).To(Equal(copyrec.Result{}))
+	})
+
+	It("should leave files with the same content in place", func() {
+		Expect(os.WriteFile(filepath.Join(tmpSrc, "unchanged"), []byte("content"), 0o644)).To(Succeed())
+		Expect(os.Link(filepath.Join(tmpSrc, "unchanged"), filepath.Join(tmpSrc, "link"))).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(tmpSrc, "changed"), []byte("new"), 0o644)).To(Succeed())
+		Expect(os.Symlink("unchanged", filepath.Join(tmpSrc, "symlink"))).To(Succeed())
+
+		Expect(os.WriteFile(filepath.Join(tmpDest, "unchanged"), []byte("content"), 0o644)).To(Succeed())
+		Expect(os.Link(filepath.Join(tmpDest, "unchanged"), filepath.Join(tmpDest, "link"))).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(tmpDest, "changed"), []byte("old"), 0o644)).To(Succeed())
+		Expect(os.Symlink("unchanged", filepath.Join(tmpDest, "symlink"))).To(Succeed())
+
+		modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		Expect(os.Chtimes(filepath.Join(tmpSrc, "unchanged"), modTime, modTime)).To(Succeed())
+		_, stat := getFileInfoAndStat(filepath.Join(tmpDest, "unchanged"))
+
+		copyRec, err := copyrec.New(tmpSrc, tmpDest, copyrec.Options{
+			CompareMethod:     copyrec.CompareContent,
+			PreserveHardLinks: true,
+			PreserveTimes:     true,
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		result, err := copyRec.RunWithResult(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.Unchanged).To(Equal(int64(3)))
+		Expect(result.Files).To(Equal(int64(1)))
+
+		fi, unchangedStat := getFileInfoAndStat(filepath.Join(tmpDest, "unchanged"))
+		Expect(unchangedStat.Ino).To(Equal(stat.Ino))
+		Expect(fi.ModTime().Equal(modTime)).To(BeTrue())
+		Expect(getFileContent(filepath.Join(tmpDest, "changed"))).To(Equal("new"))
+	})
+
+	It("should fail if cancelled while files are still being copied in parallel", func() {
+		for _, name := range []string{"a", "b", "c"} {
+			touchFile(filepath.Join(tmpSrc, name))
+		}
+
+		// Logboek falls back to the default logger only for context.Background().
+		ctx, cancel := context.WithCancel(logboek.NewContext(ctx, logboek.Context(ctx)))
+		defer cancel()
+
+		// Both workers are busy until cancellation, while the last file is being submitted.
+		var busyWorkers sync.WaitGroup
+		busyWorkers.Add(2)
+
+		copyRec, err := copyrec.New(tmpSrc, tmpDest, copyrec.Options{
+			Concurrency: 2,
+			OnFileDataCopied: func(src, dest string, method copyrec.CopyMethod) {
+				if filepath.Base(src) == "c" {
+					return
+				}
+
+				busyWorkers.Done()
+				busyWorkers.Wait()
+				if filepath.Base(src) == "a" {
+					cancel()
+				}
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(copyRec.Run(ctx)).To(MatchError(context.Canceled))
+	})
+
+	It("should skip extended attributes that can't be set without aborting copying", func() {
+		touchFile(filepath.Join(tmpSrc, "file"))
+		setXattrOrSkip(filepath.Join(tmpSrc, "file"), "user.supported", "value")
+		setXattrOrSkip(filepath.Join(tmpSrc, "file"), "user.unsupported", "value")
+
+		var xattrErrors []string
+		memDest := copyrec.NewMemDest()
+		copyRec, err := copyrec.New(tmpSrc, "/dest", copyrec.Options{
+			Dest:       xattrRejectingDest{memDest},
+			CopyXattrs: true,
+			OnXattrError: func(path, name string, err error) {
+				Expect(err).To(MatchError(unix.ENOTSUP))
+				xattrErrors = append(xattrErrors, fmt.Sprintf("%s %s", path, name))
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(copyRec.Run(ctx)).To(Succeed())
+		Expect(xattrErrors).To(Equal([]string{"/dest/file user.unsupported"}))
+
+		entry, _ := memDest.Entry("/dest/file")
+		Expect(entry.Xattrs).To(Equal(map[string][]byte{"user.supported": []byte("value")}))
+
+		// Only a warning logged by default.
+		copyRec, err = copyrec.New(tmpSrc, "/other", copyrec.Options{
+			Dest:       xattrRejectingDest{memDest},
+			CopyXattrs: true,
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(copyRec.Run(ctx)).To(Succeed())
+		entry, _ = memDest.Entry("/other/file")
+		Expect(entry.Xattrs).To(Equal(map[string][]byte{"user.supported": []byte("value")}))
+	})
+
+	It("should copy file in userspace till the end even if it is larger than its reported size", func() {
+		// Files of procfs have zero size reported, like files grown after getting their size.
+		uid, gid := uint32(os.Geteuid()), uint32(os.Getegid())
+		copyRec, err := copyrec.New("/proc/version", filepath.Join(tmpDest, "version"), copyrec.Options{
+			UID:         &uid,
+			GID:         &gid,
+			CopyMethods: []copyrec.CopyMethod{copyrec.CopyMethodUserspace},
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(copyRec.Run(ctx)).To(Succeed())
+		Expect(getFileContent(filepath.Join(tmpDest, "version"))).To(Equal(getFileContent("/proc/version")))
+		Expect(getFileContent(filepath.Join(tmpDest, "version"))).ToNot(BeEmpty())
+	})
+
+	It("should verify content of copied files", func() {
+		Expect(os.WriteFile(filepath.Join(tmpSrc, "file"), []byte("content"), 0o644)).To(Succeed())
+
+		copyRec, err := copyrec.New(tmpSrc, tmpDest, copyrec.Options{
+			VerifyContent: true,
+			VerifyHash:    md5.New,
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(copyRec.Run(ctx)).To(Succeed())
+		Expect(getFileContent(filepath.Join(tmpDest, "file"))).To(Equal("content"))
+	})
+
+	It("should hash source while copying it in userspace instead of reading it once more", func() {
+		fsys := &openCountingFS{MapFS: fstest.MapFS{
+			".":    {Mode: fs.ModeDir | 0o755},
+			"file": {Data: []byte("content"), Mode: 0o644},
+		}}
+
+		copyRec, err := copyrec.NewFS(fsys, ".", tmpDest, copyrec.Options{
+			VerifyContent: true,
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(copyRec.Run(ctx)).To(Succeed())
+		Expect(getFileContent(filepath.Join(tmpDest, "file"))).To(Equal("content"))
+		Expect(fsys.fileOpens).To(Equal(1))
+	})
+
+	It("should fail with checksum mismatch error if content of copied file differs", func() {
+		Expect(os.WriteFile(filepath.Join(tmpSrc, "file"), []byte("content"), 0o644)).To(Succeed())
+
+		// Source file hashed first, so every second hash pretends to read corrupted destination file.
+		var hashes int
+		copyRec, err := copyrec.New(tmpSrc, tmpDest, copyrec.Options{
+			VerifyContent: true,
+			VerifyHash: func() hash.Hash {
+				hashes++
+				fileHash := sha256.New()
+				if hashes%2 == 0 {
+					fileHash.Write([]byte("corrupted"))
+				}
+				return fileHash
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		err = copyRec.Run(ctx)
+
+		var mismatchErr *copyrec.ChecksumMismatchError
+		Expect(errors.As(err, &mismatchErr)).To(BeTrue())
+		Expect(mismatchErr.Src).To(Equal(filepath.Join(tmpSrc, "file")))
+		Expect(mismatchErr.Dest).To(Equal(filepath.Join(tmpDest, "file")))
+		srcChecksum := sha256.Sum256([]byte("content"))
+		Expect(mismatchErr.SrcChecksum).To(Equal(srcChecksum[:]))
+		Expect(mismatchErr.DestChecksum).ToNot(Equal(srcChecksum[:]))
+	})
+
+	It("should swap destination with staging directory and keep previous destination", func() {
+		Expect(os.Chmod(tmpSrc, 0o750)).To(Succeed())
+		Expect(os.Mkdir(filepath.Join(tmpSrc, "dir"), 0o755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(tmpSrc, "dir", "file"), []byte("content"), 0o644)).To(Succeed())
+		touchFile(filepath.Join(tmpDest, "old-file"))
+
+		copyRec, err := copyrec.New(tmpSrc, tmpDest, copyrec.Options{
+			StageAndSwap: true,
+			OldDestPath:  filepath.Join(tmpRoot, "old"),
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(copyRec.Run(ctx)).To(Succeed())
+
+		Expect(getFileContent(filepath.Join(tmpDest, "dir", "file"))).To(Equal("content"))
+		Expect(filepath.Join(tmpDest, "old-file")).ToNot(BeAnExistingFile())
+		Expect(filepath.Join(tmpRoot, "old", "old-file")).To(BeARegularFile())
+
+		fi, _ := getFileInfoAndStat(tmpDest)
+		Expect(fi.Mode().String()).To(Equal(os.FileMode(0o750 | os.ModeDir).String()))
+
+		entries, err := os.ReadDir(tmpRoot)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(HaveLen(3))
+	})
+
+	It("should swap destination with staging directory and remove previous destination", func() {
+		touchFile(filepath.Join(tmpSrc, "file"))
+		touchFile(filepath.Join(tmpDest, "old-file"))
+
+		copyRec, err := copyrec.New(tmpSrc, tmpDest, copyrec.Options{StageAndSwap: true})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(copyRec.Run(ctx)).To(Succeed())
+
+		Expect(filepath.Join(tmpDest, "file")).To(BeARegularFile())
+		Expect(filepath.Join(tmpDest, "old-file")).ToNot(BeAnExistingFile())
+
+		entries, err := os.ReadDir(tmpRoot)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(HaveLen(2))
+	})
+
+	It("should succeed if previous destination can't be moved after swapping", func() {
+		touchFile(filepath.Join(tmpSrc, "file"))
+		touchFile(filepath.Join(tmpDest, "old-file"))
+
+		copyRec, err := copyrec.New(tmpSrc, tmpDest, copyrec.Options{
+			StageAndSwap: true,
+			OldDestPath:  filepath.Join(tmpRoot, "missing", "old"),
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(copyRec.Run(ctx)).To(Succeed())
+
+		Expect(filepath.Join(tmpDest, "file")).To(BeARegularFile())
+		Expect(filepath.Join(tmpDest, "old-file")).ToNot(BeAnExistingFile())
+
+		// Previous destination left next to destination.
+		oldDests, err := filepath.Glob(filepath.Join(tmpRoot, ".dest.*.tmp", "old-file"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(oldDests).To(HaveLen(1))
+	})
+
+	It("should leave destination untouched if copying to staging directory failed", func() {
+		touchFile(filepath.Join(tmpSrc, "file"))
+		touchFile(filepath.Join(tmpDest, "old-file"))
+
+		copyRec, err := copyrec.New(tmpSrc, tmpDest, copyrec.Options{
+			StageAndSwap: true,
+			CopyMethods:  []copyrec.CopyMethod{copyrec.CopyMethod(-1)},
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(copyRec.Run(ctx)).ToNot(Succeed())
+
+		Expect(filepath.Join(tmpDest, "file")).ToNot(BeAnExistingFile())
+		Expect(filepath.Join(tmpDest, "old-file")).To(BeARegularFile())
+
+		entries, err := os.ReadDir(tmpRoot)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(HaveLen(2))
+	})
+
+	It("should not plan copying through staging directory", func() {
+		touchFile(filepath.Join(tmpSrc, "file"))
+		touchFile(filepath.Join(tmpDest, "old-file"))
+
+		copyRec, err := copyrec.New(tmpSrc, tmpDest, copyrec.Options{StageAndSwap: true})
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = copyRec.Plan(ctx)
+		Expect(err).To(HaveOccurred())
+
+		entries, err := os.ReadDir(tmpRoot)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(HaveLen(2))
+		Expect(filepath.Join(tmpDest, "old-file")).To(BeARegularFile())
+	})
+
+	It("should copy directory of fs.FS", func() {
+		modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		fsys := fstest.MapFS{
+			"root":                   {Mode: fs.ModeDir | 0o750, ModTime: modTime},
+			"root/file":              {Data: []byte("content"), Mode: 0o640, ModTime: modTime},
+			"root/readonly":          {Mode: fs.ModeDir | 0o555},
+			"root/readonly/file":     {Data: []byte("readonly"), Mode: 0o444},
+			"root/symlink":           {Data: []byte("readonly/file"), Mode: fs.ModeSymlink | 0o777},
+			"root/dangling":          {Data: []byte("../missing"), Mode: fs.ModeSymlink | 0o777},
+			"root/readonly/escaping": {Data: []byte("../../other"), Mode: fs.ModeSymlink | 0o777},
+			"other":                  {Data: []byte("other")},
+		}
+
+		copyRec, err := copyrec.NewFS(fsys, "root", tmpDest, copyrec.Options{
+			PreserveTimes:    true,
+			Symlinks:         copyrec.SymlinkSkipDangling,
+			EscapingSymlinks: copyrec.EscapingSymlinkSkip,
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		result, err := copyRec.RunWithResult(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.Skipped).To(Equal(int64(2)))
+		makeDirsWritable(tmpDest)
+
+		fi, stat := getFileInfoAndStat(filepath.Join(tmpDest, "file"))
+		Expect(fi.Mode().String()).To(Equal(os.FileMode(0o640).String()))
+		Expect(fi.ModTime().Equal(modTime)).To(BeTrue())
+		Expect(int(stat.Uid)).To(Equal(os.Geteuid()))
+		Expect(getFileContent(filepath.Join(tmpDest, "file"))).To(Equal("content"))
+
+		fi, _ = getFileInfoAndStat(tmpDest)
+		Expect(fi.Mode().String()).To(Equal(os.FileMode(0o750 | os.ModeDir).String()))
+		Expect(getFileContent(filepath.Join(tmpDest, "readonly", "file"))).To(Equal("readonly"))
+		Expect(os.Readlink(filepath.Join(tmpDest, "symlink"))).To(Equal("readonly/file"))
+		Expect(filepath.Join(tmpDest, "dangling")).ToNot(BeAnExistingFile())
+		Expect(filepath.Join(tmpDest, "readonly", "escaping")).ToNot(BeAnExistingFile())
+	})
+
+	It("should copy zip archive contents and verify them", func() {
+		archive := &bytes.Buffer{}
+		zipWriter := zip.NewWriter(archive)
+		for _, file := range []struct {
+			name, content string
+			mode          os.FileMode
+		}{
+			{"dir/file", "content", 0o600},
+			{"dir/symlink", "file", os.ModeSymlink | 0o777},
+		} {
+			header := &zip.FileHeader{Name: file.name, Method: zip.Deflate}
+			header.SetMode(file.mode)
+			writer, err := zipWriter.CreateHeader(header)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = writer.Write([]byte(file.content))
+			Expect(err).ToNot(HaveOccurred())
+		}
+		Expect(zipWriter.Close()).To(Succeed())
+
+		zipReader, err := zip.NewReader(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+		Expect(err).ToNot(HaveOccurred())
+
+		var methods []copyrec.CopyMethod
+		copyRec, err := copyrec.NewFS(zipReader, ".", tmpDest, copyrec.Options{
+			VerifyContent: true,
+			OnFileDataCopied: func(src, dest string, method copyrec.CopyMethod) {
+				methods = append(methods, method)
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(copyRec.Run(ctx)).To(Succeed())
+		// Directories implied by zip archive entries are read-only.
+		makeDirsWritable(tmpDest)
+
+		fi, _ := getFileInfoAndStat(filepath.Join(tmpDest, "dir", "file"))
+		Expect(fi.Mode().String()).To(Equal(os.FileMode(0o600).String()))
+		Expect(getFileContent(filepath.Join(tmpDest, "dir", "file"))).To(Equal("content"))
+		Expect(os.Readlink(filepath.Join(tmpDest, "dir", "symlink"))).To(Equal("file"))
+		Expect(methods).To(Equal([]copyrec.CopyMethod{copyrec.CopyMethodUserspace}))
+	})
+
+	It("should not allow following symlinks of fs.FS", func() {
+		_, err := copyrec.NewFS(fstest.MapFS{}, ".", tmpDest, copyrec.Options{Symlinks: copyrec.SymlinkFollow})
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+func intToUint32Ptr(n int) *uint32 {
+	converted := uint32(n)
+	return &converted
+}
+
+func getFirstUserGroupSortedNumerically() int {
+	groups, err := os.Getgroups()
+	Expect(err).ToNot(HaveOccurred())
+	return groups[0]
+}
+
+func touchFile(path string) {
+	_, err := os.Create(path)
+	Expect(err).ToNot(HaveOccurred())
+}
+
+func getFileInfoAndStat(path string) (os.FileInfo, *syscall.Stat_t) {
+	fileInfo, err := os.Lstat(path)
+	Expect(err).ToNot(HaveOccurred())
+
+	return fileInfo, fileInfo.Sys().(*syscall.Stat_t)
 }
 
 func getFileContent(path string) string {
@@ -446,3 +1960,83 @@ func getFileContent(path string) string {
 	Expect(err).ToNot(HaveOccurred())
 	return string(content)
 }
+
+const (
+	sparseFileSize       = 64 << 20
+	sparseFileDataOffset = 32 << 20
+)
+
+func createSparseFile(path string) {
+	file, err := os.Create(path)
+	Expect(err).ToNot(HaveOccurred())
+	defer file.Close()
+
+	Expect(file.Truncate(sparseFileSize)).To(Succeed())
+	_, err = file.WriteAt([]byte("data"), sparseFileDataOffset)
+	Expect(err).ToNot(HaveOccurred())
+}
+
+func expectSparseFileCopied(src, dest string) {
+	srcFileInfo, srcStat := getFileInfoAndStat(src)
+	destFileInfo, destStat := getFileInfoAndStat(dest)
+
+	Expect(destFileInfo.Size()).To(Equal(srcFileInfo.Size()))
+	Expect(destStat.Blocks).To(BeNumerically("<=", srcStat.Blocks*2))
+	Expect(destStat.Blocks * 512).To(BeNumerically("<", sparseFileSize/4))
+
+	content, err := os.ReadFile(dest)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(string(content[sparseFileDataOffset : sparseFileDataOffset+4])).To(Equal("data"))
+	Expect(content[:sparseFileDataOffset]).To(Equal(make([]byte, sparseFileDataOffset)))
+}
+
+var timesTestPaths = []string{
+	filepath.Join("subdir", "subsubdir", "file"),
+	filepath.Join("subdir", "symlink"),
+	filepath.Join("subdir", "subsubdir"),
+	"subdir",
+	".",
+}
+
+func setTimes(path string, t time.Time) {
+	ts := unix.NsecToTimespec(t.UnixNano())
+	Expect(unix.UtimesNanoAt(unix.AT_FDCWD, path, []unix.Timespec{ts, ts}, unix.AT_SYMLINK_NOFOLLOW)).To(Succeed())
+}
+
+// Destination not supporting extended attributes with names starting with "user.unsupported".
+type xattrRejectingDest struct {
+	*copyrec.MemDest
+}
+
+func (d xattrRejectingDest) Lsetxattr(path, name string, value []byte) error {
+	if strings.HasPrefix(name, "user.unsupported") {
+		return unix.ENOTSUP
+	}
+
+	return d.MemDest.Lsetxattr(path, name, value)
+}
+
+// File system counting opens of regular files, which can't be read from the start again.
+type openCountingFS struct {
+	fstest.MapFS
+	fileOpens int
+}
+
+func (fsys *openCountingFS) Open(name string) (fs.File, error) {
+	file, err := fsys.MapFS.Open(name)
+	if err != nil || fsys.MapFS[name] == nil || fsys.MapFS[name].Mode.IsDir() {
+		return file, err
+	}
+
+	fsys.fileOpens++
+	return struct{ fs.File }{file}, nil
+}
+
+func makeDirsWritable(root string) {
+	Expect(filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			return os.Chmod(path, info.Mode().Perm()|0o700)
+		}
+		return err
+	})).To(Succeed())
+}
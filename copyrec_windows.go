@@ -3,12 +3,27 @@
 
 package copyrec
 
-import "context"
+import (
+	"context"
+	"io/fs"
+)
 
 func New(src, dest string, opts Options) (*CopyRecurse, error) {
 	panic("not supported on Windows")
 }
 
+func NewFS(fsys fs.FS, root, dest string, opts Options) (*CopyRecurse, error) {
+	panic("not supported on Windows")
+}
+
 func (c *CopyRecurse) Run(ctx context.Context) error {
 	panic("not supported on Windows")
 }
+
+func (c *CopyRecurse) RunWithResult(ctx context.Context) (Result, error) {
+	panic("not supported on Windows")
+}
+
+func (c *CopyRecurse) Plan(ctx context.Context) ([]PlanAction, error) {
+	panic("not supported on Windows")
+}
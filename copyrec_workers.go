@@ -0,0 +1,73 @@
+package copyrec
+
+import (
+	"context"
+	"sync"
+)
+
+// Runs jobs in a fixed number of goroutines. The first job error cancels the context passed to the rest of jobs.
+type workerPool struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	jobs   chan func(ctx context.Context) error
+	wg     sync.WaitGroup
+
+	errOnce sync.Once
+	err     error
+}
+
+func newWorkerPool(ctx context.Context, workers int) *workerPool {
+	ctx, cancel := context.WithCancel(ctx)
+
+	pool := &workerPool{
+		ctx:    ctx,
+		cancel: cancel,
+		jobs:   make(chan func(ctx context.Context) error),
+	}
+
+	pool.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go pool.work()
+	}
+
+	return pool
+}
+
+func (p *workerPool) work() {
+	defer p.wg.Done()
+
+	for job := range p.jobs {
+		// Draining the rest of jobs after cancellation without running them, the job is not done so it is an error.
+		if err := p.ctx.Err(); err != nil {
+			p.errOnce.Do(func() { p.err = err })
+			continue
+		}
+
+		if err := job(p.ctx); err != nil {
+			p.errOnce.Do(func() {
+				p.err = err
+				p.cancel()
+			})
+		}
+	}
+}
+
+// Blocks until one of workers is free. Returns the context error if the pool was cancelled.
+func (p *workerPool) submit(job func(ctx context.Context) error) error {
+	select {
+	case p.jobs <- job:
+		return nil
+	case <-p.ctx.Done():
+		return p.ctx.Err()
+	}
+}
+
+// Waits for all submitted jobs and returns the first job error, or the context error if some of jobs skipped after
+// cancellation.
+func (p *workerPool) wait() error {
+	close(p.jobs)
+	p.wg.Wait()
+	p.cancel()
+
+	return p.err
+}
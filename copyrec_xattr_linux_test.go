@@ -0,0 +1,29 @@
+package copyrec_test
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"golang.org/x/sys/unix"
+)
+
+var errXattrNotFound = unix.ENODATA
+
+func setXattrOrSkip(path, name, value string) {
+	err := unix.Lsetxattr(path, name, []byte(value), 0)
+	if errors.Is(err, unix.ENOTSUP) {
+		Skip("extended attributes not supported by filesystem")
+	}
+	Expect(err).ToNot(HaveOccurred())
+}
+
+func getXattr(path, name string) (string, error) {
+	value := make([]byte, 64)
+	size, err := unix.Lgetxattr(path, name, value)
+	if err != nil {
+		return "", err
+	}
+
+	return string(value[:size]), nil
+}
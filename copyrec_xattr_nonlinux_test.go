@@ -0,0 +1,21 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package copyrec_test
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo/v2"
+)
+
+// Extended attributes are copied only on Linux.
+var errXattrNotFound = errors.New("extended attribute not found")
+
+func setXattrOrSkip(path, name, value string) {
+	Skip("extended attributes are supported only on Linux")
+}
+
+func getXattr(path, name string) (string, error) {
+	return "", errXattrNotFound
+}